@@ -2,137 +2,394 @@ package main
 
 import (
 	"encoding/binary"
+	"fmt"
+	"github.com/asimshankar/triangles/sim"
 	"github.com/asimshankar/triangles/spec"
+	"golang.org/x/mobile/event/size"
 	"golang.org/x/mobile/exp/f32"
 	"golang.org/x/mobile/exp/gl/glutil"
 	"golang.org/x/mobile/gl"
-	"math"
 )
 
 // GL encapsulates all the GL commands for drawing a set of spec.Triangles.
+//
+// The outlines of shapes and rectangles (see outlines) are uploaded to the
+// vertex shader once, by Init. Every frame, only the position, orientation,
+// size and color of every object are streamed, in a single buffer drawn with a
+// single draw call. As instanced drawing is not available on devices that
+// only support OpenGL ES 2, these are repeated for every vertex of the object,
+// along with the index of the vertex in outlines.
 type GL struct {
-	ctx      gl.Context
-	program  gl.Program
-	buf      gl.Buffer
-	position gl.Attrib
-	offset   gl.Uniform
-	color    gl.Uniform
+	ctx       gl.Context
+	program   gl.Program
+	buf       gl.Buffer
+	corner    gl.Attrib
+	offset    gl.Attrib
+	transform gl.Attrib
+	color     gl.Attrib
+
+	vertices  []float32 // Contents of buf, reused across frames
+	drawCalls int       // Number of draw calls made by the last Paint
 }
 
-// NewGL returns a GL. ctx can be nil and the returned value can be nil, which
-// is okay, a nil *GL functions correctly and doesn't crash.
-func NewGL(ctx gl.Context) (*GL, error) {
+// Init compiles the shader program, uploads outlines to it and allocates the
+// buffer used to paint on ctx.
+func (g *GL) Init(ctx gl.Context) error {
 	if ctx == nil {
-		return nil, nil
+		return fmt.Errorf("no GL context to paint on")
 	}
 	program, err := glutil.CreateProgram(ctx, vertexShader, fragmentShader)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	*g = GL{
+		ctx:       ctx,
+		program:   program,
+		buf:       ctx.CreateBuffer(),
+		corner:    ctx.GetAttribLocation(program, "corner"),
+		offset:    ctx.GetAttribLocation(program, "offset"),
+		transform: ctx.GetAttribLocation(program, "transform"),
+		color:     ctx.GetAttribLocation(program, "color"),
 	}
-	g := &GL{
-		ctx:      ctx,
-		program:  program,
-		buf:      ctx.CreateBuffer(),
-		position: ctx.GetAttribLocation(program, "position"),
-		color:    ctx.GetUniformLocation(program, "color"),
-		offset:   ctx.GetUniformLocation(program, "offset"),
+	data := make([]float32, 0, 2*len(outlines))
+	for _, v := range outlines {
+		data = append(data, v[0], v[1])
 	}
-	return g, nil
+	ctx.UseProgram(program)
+	ctx.Uniform2fv(ctx.GetUniformLocation(program, "outlines"), data)
+	return nil
 }
 
+// Release frees the GL resources allocated by Init.
 func (g *GL) Release() {
-	if g == nil {
-		return
-	}
 	g.ctx.DeleteProgram(g.program)
 	g.ctx.DeleteBuffer(g.buf)
+	*g = GL{}
 }
 
+// DrawCalls returns the number of draw calls made by the last call to Paint.
+func (g *GL) DrawCalls() int { return g.drawCalls }
+
 type Color struct {
 	R, G, B float32
 }
 
 // Scene represents the state of the game to be painted on the screen.
 type Scene struct {
-	Triangles  []*spec.Triangle
-	TopBanner  Color  // Color of the banner to be drawn on the top of the screen identifying this screen.
-	LeftBanner *Color // If non-nil, a banner of this color will be drawn on the left edge.
+	Triangles []*spec.Triangle
+	TopBanner Color // Color of the banner to be drawn on the top of the screen identifying this screen.
+	// If non-nil, a banner of this color will be drawn on the edge
+	// identified by InvitationEdge.
+	InvitationBanner *Color
+	InvitationEdge   spec.Direction
+	// Pairing codes of the invitations sent or received across each edge,
+	// drawn next to the banner along it (see codeDigit).
+	Codes map[spec.Direction]string
+	// Colors of the screens that the user can pick to invite to stand on
+	// each edge, drawn as swatches along it (see candidateSwatch). Unlike
+	// the web client, native screens do not label them with their OS.
+	Candidates map[spec.Direction][]Color
+	// If non-nil, a marker is drawn across the screen at this position
+	// along the edge identified by MarkerEdge, for the user to line up
+	// with the marker on the screen on that edge.
+	Marker     *float32
+	MarkerEdge spec.Direction
+	Size       size.Event
 }
 
 func (g *GL) Paint(scn Scene) {
-	if g == nil {
-		return
-	}
 	g.ctx.ClearColor(0, 0, 0, 1)
 	g.ctx.Clear(gl.COLOR_BUFFER_BIT)
+	g.drawCalls = 0
 
-	g.ctx.UseProgram(g.program)
+	g.vertices = appendScene(g.vertices[:0], scn)
 
+	g.ctx.UseProgram(g.program)
 	g.ctx.BindBuffer(gl.ARRAY_BUFFER, g.buf)
-	g.ctx.BufferData(gl.ARRAY_BUFFER, triangleData, gl.STATIC_DRAW)
-	g.ctx.EnableVertexAttribArray(g.position)
-	g.ctx.VertexAttribPointer(g.position, coordsPerVertex, gl.FLOAT, false, 0, 0)
+	g.ctx.BufferData(gl.ARRAY_BUFFER, f32.Bytes(binary.LittleEndian, g.vertices...), gl.STREAM_DRAW)
+	attribs := []struct {
+		attrib gl.Attrib
+		size   int
+	}{
+		{g.corner, 1},
+		{g.offset, 2},
+		{g.transform, 3},
+		{g.color, 3},
+	}
+	var offset int
+	for _, a := range attribs {
+		g.ctx.EnableVertexAttribArray(a.attrib)
+		g.ctx.VertexAttribPointer(a.attrib, a.size, gl.FLOAT, false, 4*floatsPerVertex, 4*offset)
+		offset += a.size
+	}
+	g.ctx.DrawArrays(gl.TRIANGLES, 0, len(g.vertices)/floatsPerVertex)
+	g.drawCalls++
+	for _, a := range attribs {
+		g.ctx.DisableVertexAttribArray(a.attrib)
+	}
+}
+
+// appendScene appends to vertices the attributes of every vertex to be drawn
+// for scn, in the order in which they should be drawn.
+func appendScene(vertices []float32, scn Scene) []float32 {
 	for _, t := range scn.Triangles {
-		g.ctx.Uniform4f(g.color, t.R, t.G, t.B, 1)
-		g.ctx.Uniform2f(g.offset, t.X, t.Y)
-		g.ctx.DrawArrays(gl.TRIANGLES, 0, vertexCount)
+		size := sim.Size(t)
+		vertices = appendObject(vertices, object{shapeOutlines[t.Shape], t.X, t.Y, t.Angle, size, size}, Color{t.R, t.G, t.B})
+	}
+	vertices = appendObject(vertices, rect(-1, 1-bannerWidth, 1, 1), scn.TopBanner)
+	for _, d := range spec.DirectionAll {
+		colors := scn.Candidates[d]
+		for i, c := range colors {
+			vertices = appendObject(vertices, rect(candidateSwatch(d, i, len(colors))), c)
+		}
+	}
+	if c := scn.InvitationBanner; c != nil {
+		vertices = appendObject(vertices, rect(edgeBanner(scn.InvitationEdge)), *c)
+	}
+	for d, code := range scn.Codes {
+		for i, c := range code {
+			for _, seg := range digitSegments(c) {
+				vertices = appendObject(vertices, rect(codeSegment(d, i, len(code), seg)), codeColor)
+			}
+		}
+	}
+	if m := scn.Marker; m != nil {
+		vertices = appendObject(vertices, rect(markerRect(scn.MarkerEdge, *m)), markerColor)
 	}
-	if c := scn.TopBanner; true {
-		g.ctx.BufferData(gl.ARRAY_BUFFER, topBannerData, gl.STATIC_DRAW)
-		g.ctx.Uniform4f(g.color, c.R, c.G, c.B, 1)
-		g.ctx.Uniform2f(g.offset, 0, 0)
-		g.ctx.DrawArrays(gl.TRIANGLE_FAN, 0, 4)
+	return vertices
+}
+
+// outlineRange identifies the vertices of an outline in outlines.
+type outlineRange struct {
+	first, count int
+}
+
+// object is an outline scaled (horizontally and vertically), then rotated
+// counter-clockwise by angle (in radians) and centered at (x, y).
+type object struct {
+	outline        outlineRange
+	x, y, angle    float32
+	scaleX, scaleY float32
+}
+
+// rect returns the object covering a rectangle.
+func rect(minX, minY, maxX, maxY float32) object {
+	return object{rectOutline, (minX + maxX) / 2, (minY + maxY) / 2, 0, maxX - minX, maxY - minY}
+}
+
+// appendObject appends to vertices the attributes of every vertex of o.
+func appendObject(vertices []float32, o object, c Color) []float32 {
+	for i := o.outline.first; i < o.outline.first+o.outline.count; i++ {
+		vertices = append(vertices, float32(i), o.x, o.y, o.angle, o.scaleX, o.scaleY, c.R, c.G, c.B)
 	}
-	if c := scn.LeftBanner; c != nil {
-		g.ctx.BufferData(gl.ARRAY_BUFFER, leftBannerData, gl.STATIC_DRAW)
-		g.ctx.Uniform4f(g.color, c.R, c.G, c.B, 1)
-		g.ctx.Uniform2f(g.offset, 0, 0)
-		g.ctx.DrawArrays(gl.TRIANGLE_FAN, 0, 4)
+	return vertices
+}
+
+// newOutlines returns the vertices of the outline (as a list of triangles) of
+// every shape of unit size, followed by those of a unit square centered at
+// the origin, along with where each of them is.
+func newOutlines() (vertices [][2]float32, shapes map[spec.Shape]outlineRange, square outlineRange) {
+	add := func(fan [][2]float32) outlineRange {
+		r := outlineRange{first: len(vertices)}
+		vertices = append(vertices, fan2triangles(fan)...)
+		r.count = len(vertices) - r.first
+		return r
+	}
+	shapes = make(map[spec.Shape]outlineRange)
+	for _, shape := range spec.ShapeAll {
+		shapes[shape] = add(sim.Outline(shape, 1))
+	}
+	square = add([][2]float32{{-0.5, 0.5}, {0.5, 0.5}, {0.5, -0.5}, {-0.5, -0.5}})
+	return vertices, shapes, square
+}
+
+// fan2triangles converts the vertices of a triangle fan into a list of
+// triangles.
+func fan2triangles(fan [][2]float32) [][2]float32 {
+	var ret [][2]float32
+	for i := 1; i+1 < len(fan); i++ {
+		ret = append(ret, fan[0], fan[i], fan[i+1])
 	}
-	g.ctx.DisableVertexAttribArray(g.position)
+	return ret
 }
 
 const (
-	vertexShader = `#version 100
-uniform vec2 offset;
+	vertexShaderFormat = `#version 100
+uniform vec2 outlines[%d];
+attribute float corner;   // Index in outlines of the vertex, before the transformation
+attribute vec2 offset;    // Position of the center of the object
+attribute vec3 transform; // Counter-clockwise rotation (in radians), horizontal and vertical scale, applied before offset
+attribute vec3 color;
 
-attribute vec4 position;
+varying vec3 vColor;
 void main() {
-	vec4 offset4 = vec4(offset.x, offset.y, 0, 0);
-	gl_Position = position + offset4;
+	vec2 p = outlines[int(corner + 0.5)] * transform.yz;
+	float c = cos(transform.x);
+	float s = sin(transform.x);
+	gl_Position = vec4(c*p.x - s*p.y + offset.x, s*p.x + c*p.y + offset.y, 0, 1);
+	vColor = color;
 }`
 
 	fragmentShader = `#version 100
 precision mediump float;
-uniform vec4 color;
+varying vec3 vColor;
 void main() {
-	gl_FragColor = color;
+	gl_FragColor = vec4(vColor, 1);
 }`
 
-	coordsPerVertex         = 3
-	vertexCount             = 3
-	triangleSide    float32 = 0.4 // In OpenGL coordinates where the full screen in of size 2 [-1, 1]
-	bannerWidth             = 0.1
+	floatsPerVertex = 9 // corner, offset, transform, color
+	bannerWidth     = 0.1
+	markerWidth     = 0.02
+	swatchGap       = 0.01 // Between the swatches of candidates, see candidateSwatch
+	// Size of the digits of pairing codes, see codeDigit.
+	digitWidth  = 0.08
+	digitHeight = 0.16
+	digitStroke = 0.02
+	digitGap    = 0.04 // Between the digits and from the banner
 )
 
 var (
-	triangleHeight       = float32(math.Sqrt(3)) * triangleSide / 2
-	triangleCenterHeight = triangleSide / (2 * float32(math.Sqrt(3)))
-	triangleData         = f32.Bytes(binary.LittleEndian,
-		-triangleSide/2, -triangleHeight/2, 0, // bottom left
-		0, triangleHeight/2, 0, // top
-		triangleSide/2, -triangleHeight/2, 0, // bottom right
-	)
-	topBannerData = f32.Bytes(binary.LittleEndian,
-		-1, 1, 0,
-		1, 1, 0,
-		1, 1-bannerWidth, 0,
-		-1, 1-bannerWidth, 0,
-	)
-	leftBannerData = f32.Bytes(binary.LittleEndian,
-		-1, 1, 0,
-		-1+bannerWidth, 1, 0,
-		-1+bannerWidth, -1, 0,
-		-1, -1, 0,
-	)
+	markerColor = Color{1, 1, 1}
+	codeColor   = Color{1, 1, 1}
+	// Bits of the segments (see digitSegments) lit for every decimal digit.
+	sevenSegments = [10]uint8{0x3f, 0x06, 0x5b, 0x4f, 0x66, 0x6d, 0x7d, 0x07, 0x7f, 0x6f}
+	// Outlines of every shape of unit size and of the unit square that all
+	// rectangles are drawn as, uploaded to the vertex shader by Init.
+	outlines, shapeOutlines, rectOutline = newOutlines()
+	vertexShader                         = fmt.Sprintf(vertexShaderFormat, len(outlines))
 )
+
+// edgeBanner returns the rectangle covered by a banner along the edge
+// identified by d. The banner along the top is drawn below TopBanner.
+func edgeBanner(d spec.Direction) (minX, minY, maxX, maxY float32) {
+	switch d {
+	case spec.DirectionRight:
+		return 1 - bannerWidth, -1, 1, 1
+	case spec.DirectionAbove:
+		return -1, 1 - 2*bannerWidth, 1, 1 - bannerWidth
+	case spec.DirectionBelow:
+		return -1, -1, 1, -1 + bannerWidth
+	}
+	return -1, -1, -1 + bannerWidth, 1
+}
+
+// candidateSwatch returns the rectangle covered by the swatch of the i-th of
+// n candidates along the edge identified by d. The swatches split the banner
+// along that edge, from the top or the left.
+func candidateSwatch(d spec.Direction, i, n int) (minX, minY, maxX, maxY float32) {
+	minX, minY, maxX, maxY = edgeBanner(d)
+	if d == spec.DirectionAbove || d == spec.DirectionBelow {
+		w := (maxX - minX) / float32(n)
+		return minX + float32(i)*w + swatchGap, minY, minX + float32(i+1)*w - swatchGap, maxY
+	}
+	h := (maxY - minY) / float32(n)
+	return minX, maxY - float32(i+1)*h + swatchGap, maxX, maxY - float32(i)*h - swatchGap
+}
+
+// candidateAt returns the index of the candidate, out of n along the edge
+// identified by d, whose swatch contains (x, y), or -1 if there is none.
+func candidateAt(d spec.Direction, n int, x, y float32) int {
+	for i := 0; i < n; i++ {
+		minX, minY, maxX, maxY := candidateSwatch(d, i, n)
+		if x >= minX && x <= maxX && y >= minY && y <= maxY {
+			return i
+		}
+	}
+	return -1
+}
+
+// codeDigit returns the rectangle covered by the i-th of the n digits of a
+// pairing code drawn next to the banner along the edge identified by d. The
+// digits are read from left to right, centered along the edge.
+func codeDigit(d spec.Direction, i, n int) (minX, minY, maxX, maxY float32) {
+	var (
+		width = float32(n)*digitWidth + float32(n-1)*digitGap
+		left  = -width/2 + float32(i)*(digitWidth+digitGap)
+		inset = float32(bannerWidth + digitGap)
+	)
+	switch d {
+	case spec.DirectionLeft:
+		left = -1 + inset + float32(i)*(digitWidth+digitGap)
+	case spec.DirectionRight:
+		left = 1 - inset - width + float32(i)*(digitWidth+digitGap)
+	case spec.DirectionAbove:
+		// Below the banner along the top, which is below TopBanner.
+		return left, 1 - inset - bannerWidth - digitHeight, left + digitWidth, 1 - inset - bannerWidth
+	case spec.DirectionBelow:
+		return left, -1 + inset, left + digitWidth, -1 + inset + digitHeight
+	}
+	return left, -digitHeight / 2, left + digitWidth, digitHeight / 2
+}
+
+// codeSegment returns the rectangle covered by segment seg (see
+// digitSegments) of the i-th of the n digits of a pairing code drawn next to
+// the banner along the edge identified by d.
+func codeSegment(d spec.Direction, i, n, seg int) (minX, minY, maxX, maxY float32) {
+	minX, minY, maxX, maxY = codeDigit(d, i, n)
+	midY := (minY + maxY) / 2
+	switch seg {
+	case 0: // Top
+		return minX, maxY - digitStroke, maxX, maxY
+	case 1: // Top right
+		return maxX - digitStroke, midY, maxX, maxY
+	case 2: // Bottom right
+		return maxX - digitStroke, minY, maxX, midY
+	case 3: // Bottom
+		return minX, minY, maxX, minY + digitStroke
+	case 4: // Bottom left
+		return minX, minY, minX + digitStroke, midY
+	case 5: // Top left
+		return minX, midY, minX + digitStroke, maxY
+	}
+	// Middle
+	return minX, midY - digitStroke/2, maxX, midY + digitStroke/2
+}
+
+// digitSegments returns the segments lit to draw the decimal digit c on a
+// seven-segment display, numbered clockwise from the top and ending with the
+// middle one. It returns none for other characters.
+func digitSegments(c rune) []int {
+	if c < '0' || c > '9' {
+		return nil
+	}
+	var ret []int
+	for seg := 0; seg < 7; seg++ {
+		if sevenSegments[c-'0']&(1<<uint(seg)) != 0 {
+			ret = append(ret, seg)
+		}
+	}
+	return ret
+}
+
+// inEdgeBanner returns true if (x, y) is within the banner along the edge
+// identified by d.
+func inEdgeBanner(d spec.Direction, x, y float32) bool {
+	minX, minY, maxX, maxY := edgeBanner(d)
+	return x >= minX && x <= maxX && y >= minY && y <= maxY
+}
+
+// markerRect returns the rectangle covered by a marker across the screen,
+// perpendicular to the edge identified by d, at position m along it.
+func markerRect(d spec.Direction, m float32) (minX, minY, maxX, maxY float32) {
+	const w = markerWidth / 2
+	if d == spec.DirectionAbove || d == spec.DirectionBelow {
+		return m - w, -1, m + w, 1
+	}
+	return -1, m - w, 1, m + w
+}
+
+// markerPosition returns the position along the edge identified by d of a
+// marker dragged to (x, y).
+func markerPosition(d spec.Direction, x, y float32) float32 {
+	if d == spec.DirectionAbove || d == spec.DirectionBelow {
+		return x
+	}
+	return y
+}
+
+// nearMarker returns true if (x, y) is close enough to the marker at
+// position m along the edge identified by d to grab it.
+func nearMarker(d spec.Direction, m, x, y float32) bool {
+	p := markerPosition(d, x, y) - m
+	return p > -bannerWidth && p < bannerWidth
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"golang.org/x/mobile/gl"
+	"strings"
+	"testing"
+)
+
+func testScene() Scene {
+	return Scene{
+		Triangles: []*spec.Triangle{
+			{X: -0.5, Y: 0.25, Angle: 0.3, R: 1, G: 0, B: 0, Shape: spec.ShapeTriangle},
+			{X: 0.1, Y: -0.7, Angle: 1.2, R: 0, G: 1, B: 0.5, Shape: spec.ShapeSquare, Size: 0.2},
+			{X: 0.6, Y: 0.6, Angle: 2.5, R: 0.25, G: 0.5, B: 1, Shape: spec.ShapeHexagon},
+		},
+		TopBanner: Color{0.5, 0.5, 0.5},
+	}
+}
+
+func TestGLPaint(t *testing.T) {
+	var (
+		ctx = newRecordingContext()
+		g   GL
+		scn = testScene()
+	)
+	if err := g.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Release()
+	g.Paint(scn)
+	if len(ctx.Draws) == 0 {
+		t.Fatal("nothing drawn")
+	}
+	var (
+		d       = ctx.Draws[0]
+		offsets = d.Attribs["offset"]
+		colors  = d.Attribs["color"]
+		v       int // Index of the first vertex of the next triangle
+	)
+	if d.Mode != gl.TRIANGLES {
+		t.Errorf("Got mode %v, want TRIANGLES", d.Mode)
+	}
+	for i, tri := range scn.Triangles {
+		n := shapeOutlines[tri.Shape].count
+		if v+n > d.Count {
+			t.Fatalf("Triangle #%d: only %d vertices drawn, want at least %d", i, d.Count, v+n)
+		}
+		for ; n > 0; n, v = n-1, v+1 {
+			if got, want := offsets[v], []float32{tri.X, tri.Y}; !equalFloats(got, want) {
+				t.Errorf("Triangle #%d: vertex #%d has offset %v, want %v", i, v, got, want)
+			}
+			if got, want := colors[v], []float32{tri.R, tri.G, tri.B}; !equalFloats(got, want) {
+				t.Errorf("Triangle #%d: vertex #%d has color %v, want %v", i, v, got, want)
+			}
+		}
+	}
+	// The top banner comes right after the triangles.
+	if got, want := colors[v], []float32{scn.TopBanner.R, scn.TopBanner.G, scn.TopBanner.B}; !equalFloats(got, want) {
+		t.Errorf("Top banner has color %v, want %v", got, want)
+	}
+}
+
+func TestGLPaintStreamsOnlyObjects(t *testing.T) {
+	var (
+		ctx = newRecordingContext()
+		g   GL
+		scn = testScene()
+		m   = float32(0.3)
+	)
+	for i := 0; i < 100; i++ {
+		scn.Triangles = append(scn.Triangles, &spec.Triangle{X: float32(i) / 100, Shape: spec.ShapeAll[i%len(spec.ShapeAll)]})
+	}
+	scn.InvitationBanner = &Color{0, 0, 1}
+	scn.Codes = map[spec.Direction]string{spec.DirectionLeft: "0123456789"}
+	scn.Candidates = map[spec.Direction][]Color{spec.DirectionRight: {{1, 0, 0}, {0, 1, 0}}}
+	scn.Marker, scn.MarkerEdge = &m, spec.DirectionLeft
+	if err := g.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer g.Release()
+	if got, want := len(ctx.Uniforms["outlines"]), 2*len(outlines); got != want {
+		t.Errorf("Init uploaded %d floats of outlines, want %d", got, want)
+	}
+	for frame := 0; frame < 2; frame++ {
+		ctx.Reset()
+		g.Paint(scn)
+		if got := g.DrawCalls(); got != 1 {
+			t.Errorf("Frame #%d: DrawCalls() = %d, want 1", frame, got)
+		}
+		if got := len(ctx.Draws); got != 1 {
+			t.Errorf("Frame #%d: %d draw calls recorded, want 1", frame, got)
+		}
+		var uploads int
+		for _, call := range ctx.Calls {
+			if strings.HasPrefix(call, "Uniform") {
+				t.Errorf("Frame #%d: geometry uploaded again: %v", frame, call)
+			}
+			if strings.HasPrefix(call, "BufferData") {
+				uploads++
+			}
+		}
+		if got, want := uploads, 1; got != want {
+			t.Errorf("Frame #%d: %d buffers uploaded, want %d", frame, got, want)
+		}
+	}
+	// Every vertex only carries the index of its corner in outlines and the
+	// attributes of its object.
+	if got, want := len(ctx.buffers[g.buf]), 4*floatsPerVertex*ctx.Draws[0].Count; got != want {
+		t.Errorf("Streamed %d bytes, want %d", got, want)
+	}
+	for i, c := range ctx.Draws[0].Attribs["corner"] {
+		if idx := int(c[0]); float32(idx) != c[0] || idx < 0 || idx >= len(outlines) {
+			t.Errorf("Vertex #%d refers to corner %v, want an index in [0, %d)", i, c[0], len(outlines))
+		}
+	}
+}
+
+func TestGLRelease(t *testing.T) {
+	var (
+		ctx = newRecordingContext()
+		g   GL
+	)
+	if err := g.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Live() == 0 {
+		t.Fatal("Init allocated no GL resources")
+	}
+	g.Paint(testScene())
+	g.Release()
+	if n := ctx.Live(); n != 0 {
+		t.Errorf("%d GL resources not released: %v", n, ctx.Calls)
+	}
+}
+
+func equalFloats(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"golang.org/x/mobile/event/size"
+	"fmt"
 	"golang.org/x/mobile/exp/app/debug"
 	"golang.org/x/mobile/exp/gl/glutil"
 	"golang.org/x/mobile/gl"
@@ -9,34 +9,25 @@ import (
 
 // GLDebug encapsulates state for drawing debug information.
 type GLDebug struct {
-	ctx    gl.Context
 	images *glutil.Images
 	fps    *debug.FPS
 }
 
-func NewGLDebug(ctx gl.Context) *GLDebug {
+func (d *GLDebug) Init(ctx gl.Context) error {
 	if ctx == nil {
-		return nil
-	}
-	images := glutil.NewImages(ctx)
-	return &GLDebug{
-		ctx:    ctx,
-		images: images,
-		fps:    debug.NewFPS(images),
+		return fmt.Errorf("no GL context to paint on")
 	}
+	d.images = glutil.NewImages(ctx)
+	d.fps = debug.NewFPS(d.images)
+	return nil
 }
 
 func (d *GLDebug) Release() {
-	if d == nil {
-		return
-	}
 	d.fps.Release()
 	d.images.Release()
+	*d = GLDebug{}
 }
 
-func (d *GLDebug) Paint(sz size.Event) {
-	if d == nil {
-		return
-	}
-	d.fps.Draw(sz)
+func (d *GLDebug) Paint(scn Scene) {
+	d.fps.Draw(scn.Size)
 }
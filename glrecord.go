@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/mobile/gl"
+	"log"
+	"math"
+	"time"
+)
+
+// recordingContext is an in-memory gl.Context that records the calls made to
+// it (and the resources allocated) instead of drawing anything, so that GL
+// can be exercised without a display.
+//
+// Only the methods used by GL (and glutil.CreateProgram) are implemented,
+// invoking any other method panics.
+type recordingContext struct {
+	gl.Context
+
+	Calls    []string             // All calls made, in order
+	Draws    []recordedDraw       // All draw calls made, in order
+	Uniforms map[string][]float32 // Most recent value of each uniform, by name
+
+	next     uint32 // Last allocated identifier of a program, shader or buffer
+	programs map[gl.Program]bool
+	shaders  map[gl.Shader]bool
+	buffers  map[gl.Buffer][]byte // Contents of every live buffer
+	bound    gl.Buffer            // Buffer bound to ARRAY_BUFFER
+	attribs  []string             // Names of attributes, indexed by location
+	uniforms []string             // Names of uniforms, indexed by location
+	enabled  map[gl.Attrib]bool
+	pointers map[gl.Attrib]attribPointer
+}
+
+type attribPointer struct {
+	size, stride, offset int
+}
+
+// recordedDraw is a call to DrawArrays, along with the values of the vertex
+// attributes enabled at the time of the call.
+type recordedDraw struct {
+	Mode         gl.Enum
+	First, Count int
+	// Attribs holds the values of every enabled attribute (by name), for
+	// each of the Count vertices drawn.
+	Attribs map[string][][]float32
+}
+
+func newRecordingContext() *recordingContext {
+	return &recordingContext{
+		Uniforms: make(map[string][]float32),
+		programs: make(map[gl.Program]bool),
+		shaders:  make(map[gl.Shader]bool),
+		buffers:  make(map[gl.Buffer][]byte),
+		enabled:  make(map[gl.Attrib]bool),
+		pointers: make(map[gl.Attrib]attribPointer),
+	}
+}
+
+// Live returns the number of programs, shaders and buffers that have been
+// created and not yet deleted.
+func (c *recordingContext) Live() int {
+	return len(c.programs) + len(c.shaders) + len(c.buffers)
+}
+
+// Reset forgets all calls and draws recorded so far.
+func (c *recordingContext) Reset() {
+	c.Calls = nil
+	c.Draws = nil
+}
+
+func (c *recordingContext) record(format string, args ...interface{}) {
+	c.Calls = append(c.Calls, fmt.Sprintf(format, args...))
+}
+
+func (c *recordingContext) CreateProgram() gl.Program {
+	c.next++
+	p := gl.Program{Init: true, Value: c.next}
+	c.programs[p] = true
+	c.record("CreateProgram() = %v", p.Value)
+	return p
+}
+
+func (c *recordingContext) DeleteProgram(p gl.Program) {
+	delete(c.programs, p)
+	c.record("DeleteProgram(%v)", p.Value)
+}
+
+func (c *recordingContext) LinkProgram(p gl.Program) { c.record("LinkProgram(%v)", p.Value) }
+func (c *recordingContext) UseProgram(p gl.Program)  { c.record("UseProgram(%v)", p.Value) }
+
+func (c *recordingContext) GetProgrami(p gl.Program, pname gl.Enum) int {
+	// Report success for LINK_STATUS and anything else that is queried.
+	return 1
+}
+
+func (c *recordingContext) GetProgramInfoLog(p gl.Program) string { return "" }
+
+func (c *recordingContext) CreateShader(ty gl.Enum) gl.Shader {
+	c.next++
+	s := gl.Shader{Value: c.next}
+	c.shaders[s] = true
+	c.record("CreateShader(%v) = %v", ty, s.Value)
+	return s
+}
+
+func (c *recordingContext) DeleteShader(s gl.Shader) {
+	delete(c.shaders, s)
+	c.record("DeleteShader(%v)", s.Value)
+}
+
+func (c *recordingContext) ShaderSource(s gl.Shader, src string) {
+	c.record("ShaderSource(%v)", s.Value)
+}
+func (c *recordingContext) CompileShader(s gl.Shader) { c.record("CompileShader(%v)", s.Value) }
+func (c *recordingContext) AttachShader(p gl.Program, s gl.Shader) {
+	c.record("AttachShader(%v, %v)", p.Value, s.Value)
+}
+
+func (c *recordingContext) GetShaderi(s gl.Shader, pname gl.Enum) int {
+	// Report success for COMPILE_STATUS and anything else that is queried.
+	return 1
+}
+
+func (c *recordingContext) GetShaderInfoLog(s gl.Shader) string { return "" }
+
+func (c *recordingContext) GetAttribLocation(p gl.Program, name string) gl.Attrib {
+	for i, n := range c.attribs {
+		if n == name {
+			return gl.Attrib{Value: uint(i)}
+		}
+	}
+	c.attribs = append(c.attribs, name)
+	return gl.Attrib{Value: uint(len(c.attribs) - 1)}
+}
+
+func (c *recordingContext) GetUniformLocation(p gl.Program, name string) gl.Uniform {
+	for i, n := range c.uniforms {
+		if n == name {
+			return gl.Uniform{Value: int32(i)}
+		}
+	}
+	c.uniforms = append(c.uniforms, name)
+	return gl.Uniform{Value: int32(len(c.uniforms) - 1)}
+}
+
+func (c *recordingContext) uniform(dst gl.Uniform, v ...float32) {
+	name := c.uniforms[dst.Value]
+	c.Uniforms[name] = v
+	c.record("Uniform(%v, %v)", name, v)
+}
+
+func (c *recordingContext) Uniform1f(dst gl.Uniform, v float32)      { c.uniform(dst, v) }
+func (c *recordingContext) Uniform2f(dst gl.Uniform, v0, v1 float32) { c.uniform(dst, v0, v1) }
+func (c *recordingContext) Uniform4f(dst gl.Uniform, v0, v1, v2, v3 float32) {
+	c.uniform(dst, v0, v1, v2, v3)
+}
+func (c *recordingContext) Uniform2fv(dst gl.Uniform, src []float32) { c.uniform(dst, src...) }
+
+func (c *recordingContext) CreateBuffer() gl.Buffer {
+	c.next++
+	b := gl.Buffer{Value: c.next}
+	c.buffers[b] = nil
+	c.record("CreateBuffer() = %v", b.Value)
+	return b
+}
+
+func (c *recordingContext) DeleteBuffer(b gl.Buffer) {
+	delete(c.buffers, b)
+	c.record("DeleteBuffer(%v)", b.Value)
+}
+
+func (c *recordingContext) BindBuffer(target gl.Enum, b gl.Buffer) {
+	c.bound = b
+	c.record("BindBuffer(%v, %v)", target, b.Value)
+}
+
+func (c *recordingContext) BufferData(target gl.Enum, src []byte, usage gl.Enum) {
+	c.buffers[c.bound] = append([]byte(nil), src...)
+	c.record("BufferData(%v, %d bytes, %v)", target, len(src), usage)
+}
+
+func (c *recordingContext) EnableVertexAttribArray(a gl.Attrib) {
+	c.enabled[a] = true
+	c.record("EnableVertexAttribArray(%v)", c.attribs[a.Value])
+}
+
+func (c *recordingContext) DisableVertexAttribArray(a gl.Attrib) {
+	delete(c.enabled, a)
+	c.record("DisableVertexAttribArray(%v)", c.attribs[a.Value])
+}
+
+func (c *recordingContext) VertexAttribPointer(dst gl.Attrib, size int, ty gl.Enum, normalized bool, stride, offset int) {
+	c.pointers[dst] = attribPointer{size: size, stride: stride, offset: offset}
+	c.record("VertexAttribPointer(%v, %v, %v, %v, %v, %v)", c.attribs[dst.Value], size, ty, normalized, stride, offset)
+}
+
+func (c *recordingContext) ClearColor(red, green, blue, alpha float32) {
+	c.record("ClearColor(%v, %v, %v, %v)", red, green, blue, alpha)
+}
+
+func (c *recordingContext) Clear(mask gl.Enum) { c.record("Clear(%v)", mask) }
+
+// DrawArrays records the draw call along with the values of the attributes
+// of every vertex drawn, decoded from the bound buffer. All attributes are
+// assumed to be of type FLOAT.
+func (c *recordingContext) DrawArrays(mode gl.Enum, first, count int) {
+	c.record("DrawArrays(%v, %v, %v)", mode, first, count)
+	d := recordedDraw{Mode: mode, First: first, Count: count, Attribs: make(map[string][][]float32)}
+	data := c.buffers[c.bound]
+	for a := range c.enabled {
+		p := c.pointers[a]
+		stride := p.stride
+		if stride == 0 {
+			stride = 4 * p.size
+		}
+		var values [][]float32
+		for v := first; v < first+count; v++ {
+			value := make([]float32, p.size)
+			for i := range value {
+				if idx := v*stride + p.offset + 4*i; idx+4 <= len(data) {
+					value[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[idx:]))
+				}
+			}
+			values = append(values, value)
+		}
+		d.Attribs[c.attribs[a.Value]] = values
+	}
+	c.Draws = append(c.Draws, d)
+}
+
+// recordingRenderer is a GL that paints on a recordingContext instead of the
+// app's window, periodically logging what it would have drawn.
+type recordingRenderer struct {
+	GL
+	ctx  *recordingContext
+	last time.Time // When a summary was last logged
+}
+
+func (r *recordingRenderer) Init(gl.Context) error {
+	r.ctx = newRecordingContext()
+	return r.GL.Init(r.ctx)
+}
+
+func (r *recordingRenderer) Paint(scn Scene) {
+	r.ctx.Reset()
+	r.GL.Paint(scn)
+	if now := time.Now(); now.Sub(r.last) >= snapshotInterval {
+		r.last = now
+		var vertices int
+		for _, d := range r.ctx.Draws {
+			vertices += d.Count
+		}
+		log.Printf("Painted %d triangles using %d vertices in %d draw calls (%d GL calls)", len(scn.Triangles), vertices, len(r.ctx.Draws), len(r.ctx.Calls))
+	}
+}
+
+func (r *recordingRenderer) Release() {
+	r.GL.Release()
+	if n := r.ctx.Live(); n > 0 {
+		log.Printf("%d GL resources were not released", n)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"golang.org/x/mobile/gl"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+)
+
+// Headless paints a Scene into an image in software, without requiring a GL
+// context.
+//
+// It draws the same vertices as GL, transformed the same way as the vertex
+// shader, so the image it produces matches what GL would have drawn on a
+// screen of the same size (modulo anti-aliasing).
+type Headless struct {
+	img      *image.RGBA
+	vertices []float32 // Reused across frames
+}
+
+// NewHeadless returns a Headless that paints into an image of the provided
+// dimensions (in pixels).
+func NewHeadless(width, height int) *Headless {
+	return &Headless{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+// Init is a no-op, Headless does not need a GL context.
+func (h *Headless) Init(gl.Context) error { return nil }
+
+// Release is a no-op, Headless does not hold on to any resources.
+func (h *Headless) Release() {}
+
+// Image returns the image painted by the last call to Paint.
+//
+// The returned image is overwritten by subsequent calls to Paint.
+func (h *Headless) Image() *image.RGBA { return h.img }
+
+// Paint paints scn into the image, resizing it to scn.Size if that is
+// provided.
+func (h *Headless) Paint(scn Scene) {
+	if w, ht := scn.Size.WidthPx, scn.Size.HeightPx; w > 0 && ht > 0 && (w != h.img.Bounds().Dx() || ht != h.img.Bounds().Dy()) {
+		h.img = image.NewRGBA(image.Rect(0, 0, w, ht))
+	}
+	b := h.img.Bounds()
+	for i := range h.img.Pix {
+		// Opaque black, like ClearColor(0, 0, 0, 1) in GL.
+		if i%4 == 3 {
+			h.img.Pix[i] = 0xff
+		} else {
+			h.img.Pix[i] = 0
+		}
+	}
+	h.vertices = appendScene(h.vertices[:0], scn)
+	var tri [3][2]float32
+	for i := 0; i+3*floatsPerVertex <= len(h.vertices); i += 3 * floatsPerVertex {
+		for j := range tri {
+			v := h.vertices[i+j*floatsPerVertex : i+(j+1)*floatsPerVertex]
+			x, y := transformVertex(v)
+			// GL coordinates to pixels, see touch2coords.
+			tri[j] = [2]float32{(x + 1) * float32(b.Dx()) / 2, (1 - y) * float32(b.Dy()) / 2}
+		}
+		v := h.vertices[i:]
+		fillTriangle(h.img, tri, color.RGBA{
+			R: colorComponent(v[6]),
+			G: colorComponent(v[7]),
+			B: colorComponent(v[8]),
+			A: 0xff,
+		})
+	}
+}
+
+// WritePNG encodes the image painted by the last call to Paint as a PNG.
+func (h *Headless) WritePNG(w io.Writer) error {
+	return png.Encode(w, h.img)
+}
+
+// SavePNG writes the image painted by the last call to Paint to a PNG file.
+func (h *Headless) SavePNG(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := h.WritePNG(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// transformVertex returns the GL coordinates of a vertex (produced by
+// appendObject), mirroring vertexShader.
+func transformVertex(v []float32) (x, y float32) {
+	p := outlines[int(v[0]+0.5)]
+	px, py := p[0]*v[4], p[1]*v[5]
+	sin, cos := math.Sincos(float64(v[3]))
+	c, s := float32(cos), float32(sin)
+	return c*px - s*py + v[1], s*px + c*py + v[2]
+}
+
+// fillTriangle fills the pixels of img whose centers lie within tri.
+func fillTriangle(img *image.RGBA, tri [3][2]float32, c color.RGBA) {
+	var (
+		b                      = img.Bounds()
+		minX, minY, maxX, maxY = tri[0][0], tri[0][1], tri[0][0], tri[0][1]
+	)
+	for _, p := range tri[1:] {
+		minX, maxX = float32(math.Min(float64(minX), float64(p[0]))), float32(math.Max(float64(maxX), float64(p[0])))
+		minY, maxY = float32(math.Min(float64(minY), float64(p[1]))), float32(math.Max(float64(maxY), float64(p[1])))
+	}
+	r := image.Rect(int(math.Floor(float64(minX))), int(math.Floor(float64(minY))), int(math.Ceil(float64(maxX))), int(math.Ceil(float64(maxY)))).Intersect(b)
+	area := edge(tri[0], tri[1], tri[2])
+	if area == 0 {
+		return
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := [2]float32{float32(x) + 0.5, float32(y) + 0.5}
+			w0, w1, w2 := edge(tri[1], tri[2], p), edge(tri[2], tri[0], p), edge(tri[0], tri[1], p)
+			if area < 0 {
+				w0, w1, w2 = -w0, -w1, -w2
+			}
+			if w0 >= 0 && w1 >= 0 && w2 >= 0 {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+// edge returns twice the signed area of the triangle (a, b, p).
+func edge(a, b, p [2]float32) float32 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
+
+func colorComponent(f float32) uint8 {
+	switch {
+	case f <= 0:
+		return 0
+	case f >= 1:
+		return 0xff
+	}
+	return uint8(f*0xff + 0.5)
+}
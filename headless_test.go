@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"github.com/asimshankar/triangles/spec"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var flagUpdateGolden = flag.Bool("update", false, "Whether to overwrite the golden images in testdata with what Headless paints")
+
+// goldenScenes are painted by TestHeadlessGolden, and compared to
+// testdata/<name>.png.
+var goldenScenes = map[string]Scene{
+	"triangles": testScene(),
+	"invitation": func() Scene {
+		scn := testScene()
+		m := float32(-0.4)
+		scn.InvitationBanner = &Color{0, 0, 1}
+		scn.InvitationEdge = spec.DirectionLeft
+		scn.Codes = map[spec.Direction]string{spec.DirectionLeft: "4096"}
+		scn.Candidates = map[spec.Direction][]Color{
+			spec.DirectionRight: {{1, 0, 0}, {0, 1, 0}, {1, 1, 0}},
+			spec.DirectionBelow: {{0, 1, 1}},
+		}
+		scn.Marker, scn.MarkerEdge = &m, spec.DirectionAbove
+		return scn
+	}(),
+}
+
+func TestHeadlessGolden(t *testing.T) {
+	for name, scn := range goldenScenes {
+		var (
+			h      = NewHeadless(160, 120)
+			golden = filepath.Join("testdata", name+".png")
+		)
+		h.Paint(scn)
+		if *flagUpdateGolden {
+			if err := h.SavePNG(golden); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := readPNG(golden)
+		if err != nil {
+			t.Errorf("%v (run with -update to create it)", err)
+			continue
+		}
+		if got := h.Image(); !got.Bounds().Eq(want.Bounds()) {
+			t.Errorf("%v: painted a %v image, want %v", name, got.Bounds(), want.Bounds())
+			continue
+		}
+		if n := differentPixels(h.Image(), want); n > 0 {
+			f, err := ioutil.TempFile("", name+"-")
+			if err == nil {
+				err = h.WritePNG(f)
+				f.Close()
+			}
+			if err != nil {
+				t.Errorf("%v: %d pixels differ from %v (failed to save the painted image: %v)", name, n, golden, err)
+				continue
+			}
+			t.Errorf("%v: %d pixels differ from %v, see %v", name, n, golden, f.Name())
+		}
+	}
+}
+
+func readPNG(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func differentPixels(a, b image.Image) int {
+	var n int
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -5,8 +5,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/asimshankar/triangles/sim"
 	"github.com/asimshankar/triangles/spec"
+	"github.com/pborman/uuid"
 	"golang.org/x/mobile/app"
 	"golang.org/x/mobile/event/lifecycle"
 	"golang.org/x/mobile/event/paint"
@@ -14,31 +17,59 @@ import (
 	"golang.org/x/mobile/event/touch"
 	"golang.org/x/mobile/gl"
 	"log"
+	"math"
 	"time"
 )
 
 func main() {
+	flag.Parse()
+	if len(*flagWeb) > 0 {
+		log.Fatal(serveWeb(*flagWeb))
+	}
+	if *flagSimulate > 0 {
+		if err := runSimulation(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	renderer, err := newRenderer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	transport, err := newTransport()
+	if err != nil {
+		log.Fatal(err)
+	}
 	app.Main(func(a app.App) {
 		var (
 			scene Scene
-			myGL  *GL
-			debug *GLDebug
+			world = sim.NewWorld()
 			sz    size.Event
 
-			touches          = make(map[touch.Sequence]*touchEvents) // Active touch events
-			touchedTriangles = make(map[*spec.Triangle]struct{})     // Triangles currently being touched
+			lastPaint time.Time // When the world was last advanced
+
+			touches = make(map[touch.Sequence]*touchEvents) // Active touch events
 
 			chMyScreen      = make(chan *spec.Triangle) // New triangles to draw on my screen
-			leftScreen      = newOtherScreen(nil, chMyScreen)
-			rightScreen     = newOtherScreen(nil, chMyScreen)
-			networkChannels = SetupNetwork(chMyScreen)
+			otherScreens    = make(map[spec.Direction]*otherScreen)
+			networkChannels = SetupNetwork(transport, chMyScreen)
 
-			spawnTriangle = func(x float32) {
+			spawnTriangle = func(x, size float32, shape spec.Shape) {
 				c := scene.TopBanner
-				scene.Triangles = append(scene.Triangles, &spec.Triangle{
-					X: x, Y: 1, R: c.R, G: c.G, B: c.B})
+				t := &spec.Triangle{
+					X: x, Y: 1, R: c.R, G: c.G, B: c.B, Size: size, Shape: shape,
+					Id: uuid.New(), Origin: screenID}
+				trace(t, "spawned")
+				world.Add(t)
 			}
 
+			// The marker being lined up with the one on a new neighbour,
+			// drawn while scene.Marker is non-nil.
+			marker float32
+
+			// Screens that the user can pick to invite, see --pick.
+			candidates = make(map[spec.Direction][]Candidate)
+
 			invitationActive       bool
 			invitation             Invitation
 			invitationTicker       *time.Ticker
@@ -48,9 +79,15 @@ func main() {
 				invitation = Invitation{}
 				invitationTicker.Stop()
 				invitationBannerTicker = nil
-				scene.LeftBanner = nil
+				scene.InvitationBanner = nil
+				delete(scene.Codes, scene.InvitationEdge)
 			}
 		)
+		for _, dir := range spec.DirectionAll {
+			otherScreens[dir] = newOtherScreen(dir, nil, chMyScreen)
+		}
+		scene.Candidates = make(map[spec.Direction][]Color)
+		scene.Codes = make(map[spec.Direction]string)
 		for {
 			select {
 			case ready := <-networkChannels.Ready:
@@ -59,7 +96,7 @@ func main() {
 					log.Panic(v)
 				case Color:
 					scene.TopBanner = v
-					spawnTriangle(0)
+					spawnTriangle(0, sim.DefaultSize, spec.ShapeTriangle)
 				default:
 					log.Panicf("Unexpected type from the Ready channel: %T (%v)", ready, ready)
 				}
@@ -69,139 +106,181 @@ func main() {
 				invitation = inv
 				invitationTicker = time.NewTicker(time.Second)
 				invitationBannerTicker = invitationTicker.C
-				log.Printf("Notifying user of invitation from %v", inv.Name)
+				scene.InvitationEdge = inv.Direction
+				scene.Codes[inv.Direction] = inv.Code
+				log.Printf("Notifying user of invitation from %v on the %v, with pairing code %v", inv.Name, inv.Direction, inv.Code)
 			case <-invitationBannerTicker:
 				// Flash the banner
-				if scene.LeftBanner == nil {
-					scene.LeftBanner = &invitation.Color
+				if scene.InvitationBanner == nil {
+					scene.InvitationBanner = &invitation.Color
 					break
 				}
-				scene.LeftBanner = nil
+				scene.InvitationBanner = nil
 			case <-invitation.Withdrawn:
 				log.Printf("Invitation from %v withdrawn", invitation.Name)
 				clearInvitation()
-			case ch := <-networkChannels.NewLeftScreen:
-				leftScreen.close()
-				leftScreen = newOtherScreen(ch, chMyScreen)
-			case ch := <-networkChannels.NewRightScreen:
-				rightScreen.close()
-				rightScreen = newOtherScreen(ch, chMyScreen)
+			case p := <-networkChannels.Pairings:
+				if len(p.Code) == 0 {
+					delete(scene.Codes, p.Direction)
+					break
+				}
+				scene.Codes[p.Direction] = p.Code
+			case c := <-networkChannels.Candidates:
+				list := updateCandidates(candidates[c.Direction], c)
+				candidates[c.Direction] = list
+				colors := make([]Color, len(list))
+				for i, c := range list {
+					colors[i] = c.Color
+				}
+				scene.Candidates[c.Direction] = colors
+			case n := <-networkChannels.Neighbours:
+				otherScreens[n.Direction].close()
+				otherScreens[n.Direction] = newOtherScreen(n.Direction, n.Triangles, chMyScreen)
+				if n.Triangles != nil {
+					// Let the user line this screen up with the new neighbour.
+					log.Printf("Calibrating alignment with the screen on my %v", n.Direction)
+					marker = 0
+					scene.Marker = &marker
+					scene.MarkerEdge = n.Direction
+				} else if scene.Marker != nil && scene.MarkerEdge == n.Direction {
+					scene.Marker = nil
+				}
+				switch n.Direction {
+				case spec.DirectionAbove:
+					world.OpenAbove = n.Triangles != nil
+				case spec.DirectionBelow:
+					world.OpenBelow = n.Triangles != nil
+				}
 			case t := <-chMyScreen:
-				scene.Triangles = append(scene.Triangles, t)
+				world.Add(t)
 			case e := <-a.Events():
 				switch e := a.Filter(e).(type) {
 				case lifecycle.Event:
 					switch e.Crosses(lifecycle.StageVisible) {
 					case lifecycle.CrossOn:
 						glctx, _ := e.DrawContext.(gl.Context)
-						var err error
-						if myGL, err = NewGL(glctx); err != nil {
+						if err := renderer.Init(glctx); err != nil {
 							log.Panic(err)
 						}
-						debug = NewGLDebug(glctx)
 						a.Send(paint.Event{})
 					case lifecycle.CrossOff:
 						if exitOnLifecycleCrossOff() {
 							return
 						}
-						myGL.Release()
-						debug.Release()
-						debug = nil
-						myGL = nil
+						renderer.Release()
+						lastPaint = time.Time{}
 					}
 				case paint.Event:
 					if e.External {
 						continue
 					}
-					var mine, left, right []*spec.Triangle
-					// Handle any collisions between triangles.
-					for i, t1 := range scene.Triangles {
-						for j := i + 1; j < len(scene.Triangles); j++ {
-							t2 := scene.Triangles[j]
-							if dx, dy := (t1.X - t2.X), (t1.Y - t2.Y); dx*dx+dy*dy < triangleSide*triangleSide {
-								t1.Dx, t2.Dx = t2.Dx, t1.Dx
-								t1.Dy, t2.Dy = t2.Dy, t1.Dy
-							}
-						}
-					}
-					for _, t := range scene.Triangles {
-						if _, touched := touchedTriangles[t]; !touched {
-							// Only move a triangle if it is not currently being manipulated by the user.
-							moveTriangle(t)
-						}
-						switch {
-						case t.X < -1:
-							left = append(left, t)
-						case t.X > 1:
-							right = append(right, t)
-						default:
-							mine = append(mine, t)
-						}
+					var gone sim.Departures
+					if now := time.Now(); lastPaint.IsZero() {
+						lastPaint = now
+					} else {
+						gone = world.Advance(now.Sub(lastPaint))
+						lastPaint = now
 					}
-					if len(left) > 0 {
-						go leftScreen.send(left)
+					for dir, triangles := range gone {
+						go otherScreens[dir].send(triangles)
 					}
-					if len(right) > 0 {
-						go rightScreen.send(right)
-					}
-					scene.Triangles = mine
-					myGL.Paint(scene)
-					debug.Paint(sz)
+					scene.Triangles = world.Triangles
+					renderer.Paint(scene)
 					a.Publish()
 					a.Send(paint.Event{})
 				case size.Event:
 					sz = e
+					scene.Size = e
+					networkChannels.Resize(e)
 				case touch.Event:
 					switch e.Type {
 					case touch.TypeBegin:
 						var (
-							touchedT *spec.Triangle
-							x, y     = touch2coords(e, sz)
+							x, y = touch2coords(e, sz)
+							tch  = &touchEvents{Start: e, Began: time.Now()}
 						)
-						for _, t := range scene.Triangles {
-							if dx, dy := (x - t.X), (y - t.Y); dx*dx+dy*dy < triangleSide*triangleSide {
-								log.Printf("Triangle %+v touched by user", t)
-								touchedT = t
-								touchedTriangles[t] = struct{}{}
-								break
-							}
+						if m := scene.Marker; m != nil && nearMarker(scene.MarkerEdge, *m, x, y) {
+							tch.Marker = true
+							tch.GrabX = *m
+							touches[e.Sequence] = tch
+							break
+						}
+						tch.Triangle = world.TriangleAt(x, y)
+						if t := tch.Triangle; t != nil {
+							log.Printf("Triangle %+v touched by user", t)
+							// Do not move the triangle while it is being manipulated by the user.
+							world.Hold(t)
+							tch.GrabX, tch.GrabY = x-t.X, y-t.Y
 						}
-						touches[e.Sequence] = &touchEvents{Start: e, Triangle: touchedT}
+						touches[e.Sequence] = tch
 					case touch.TypeMove:
 						tch := touches[e.Sequence]
-						if tch.Triangle != nil {
-							tch.Triangle.X, tch.Triangle.Y = touch2coords(e, sz)
+						if tch.Marker && scene.Marker != nil {
+							x, y := touch2coords(e, sz)
+							marker = markerPosition(scene.MarkerEdge, x, y)
+						}
+						if t := tch.Triangle; t != nil {
+							x, y := touch2coords(e, sz)
+							t.X, t.Y = x-tch.GrabX, y-tch.GrabY
 						}
 					case touch.TypeEnd:
 						tch := touches[e.Sequence]
 						delete(touches, e.Sequence)
 						x, y := touch2coords(tch.Start, sz)
+						if tch.Marker {
+							if scene.Marker == nil {
+								// The neighbour was lost while the marker was being dragged.
+								break
+							}
+							x1, y1 := touch2coords(e, sz)
+							marker = markerPosition(scene.MarkerEdge, x1, y1)
+							if d := marker - tch.GrabX; d*d < markerWidth*markerWidth && time.Since(tch.Began) < maxTapDuration {
+								// Tapped the marker without moving it: done calibrating.
+								log.Printf("Finished calibrating alignment with the screen on my %v", scene.MarkerEdge)
+								scene.Marker = nil
+								break
+							}
+							log.Printf("Marker for the screen on my %v moved to %v", scene.MarkerEdge, marker)
+							networkChannels.Align(scene.MarkerEdge, marker)
+							break
+						}
 						if t := tch.Triangle; t != nil {
-							// Set triangle velocity based on movement from the original position.
-							t.X, t.Y = touch2coords(e, sz)
-							t.Dx = (e.X - tch.Start.X) / float32(sz.WidthPx)
-							t.Dy = (e.Y - tch.Start.Y) / float32(sz.HeightPx)
-							delete(touchedTriangles, t)
+							// Set triangle velocity based on movement from the original position,
+							// spinning it if it was not dragged by its center.
+							x1, y1 := touch2coords(e, sz)
+							t.X, t.Y = x1-tch.GrabX, y1-tch.GrabY
+							t.Dx, t.Dy = flickVelocity(x, y, x1, y1, time.Since(tch.Began))
+							t.Omega = sim.Spin(t, tch.GrabX, tch.GrabY, t.Dx, t.Dy)
+							world.Release(t)
 							break
 						}
-						if invitationActive && x < bannerWidth {
-							// Touched in the left invitation banner:
-							// Swipe = reject, Tap = accept.
+						if invitationActive && inEdgeBanner(invitation.Direction, x, y) {
+							// Touched in the invitation banner:
+							// Swipe = reject, Tap = accept, confirming
+							// that the inviter displays the same code.
 							var swipeThreshold = float32(sz.WidthPx) / 2
 							if dx, dy := (e.X - tch.Start.X), (e.Y - tch.Start.Y); dx*dx+dy*dy > swipeThreshold*swipeThreshold {
 								log.Printf("Swiped (%v, %v) pixels, rejecting invitation from %q", dx, dy, invitation.Name)
 								invitation.Response <- fmt.Errorf("user rejected")
 							} else {
-								log.Printf("Accepting invitation from %q", invitation.Name)
+								log.Printf("Accepting invitation from %q, with pairing code %v", invitation.Name, invitation.Code)
 								invitation.Response <- nil
 							}
 							clearInvitation()
 							break
 						}
+						if dir, c, ok := candidateTouched(candidates, x, y); ok {
+							log.Printf("User picked %q (%v) to invite to my %v", c.Id, c.OS, dir)
+							networkChannels.Pick(dir, c.Id)
+							break
+						}
 						if y >= 1-(2*bannerWidth) {
-							// Touched top banner, spawn a new triangle
-							log.Printf("Top banner touched, spawning new triangle (Y=%v, threshold=%v)", y, -1+bannerWidth)
-							spawnTriangle(x)
+							// Touched top banner, spawn a new triangle.
+							// Dragging along the banner picks the size and holding it down picks the shape.
+							x1, _ := touch2coords(e, sz)
+							size, shape := spawnChoice(x1-x, time.Since(tch.Began))
+							log.Printf("Top banner touched, spawning new %v of size %v (Y=%v, threshold=%v)", shape, size, y, -1+bannerWidth)
+							spawnTriangle(x, size, shape)
 							break
 						}
 					}
@@ -212,18 +291,25 @@ func main() {
 }
 
 type touchEvents struct {
-	Start    touch.Event    // Where the touch event began
-	Triangle *spec.Triangle // The triangle being manipulated by touch, if any
+	Start        touch.Event    // Where the touch event began
+	Began        time.Time      // When the touch event began
+	Triangle     *spec.Triangle // The triangle being manipulated by touch, if any
+	GrabX, GrabY float32        // Offset of the touch from the center of Triangle
+	// Marker is true if the touch is dragging the alignment marker, which
+	// was at GrabX when the touch began.
+	Marker bool
 }
 
 type otherScreen struct {
+	direction   spec.Direction // Position of the other screen relative to mine
 	chTriangles chan<- *spec.Triangle
 	chLost      chan struct{}
 	chSelf      chan<- *spec.Triangle
 }
 
-func newOtherScreen(other, self chan<- *spec.Triangle) *otherScreen {
+func newOtherScreen(direction spec.Direction, other, self chan<- *spec.Triangle) *otherScreen {
 	return &otherScreen{
+		direction:   direction,
 		chTriangles: other,
 		chLost:      make(chan struct{}),
 		chSelf:      self,
@@ -234,10 +320,13 @@ func (s *otherScreen) close() {
 	close(s.chLost)
 }
 
+// send hands triangles off to the other screen. Every triangle is either
+// accepted by the network layer, which then either delivers it or returns it,
+// or reflected back onto my screen, exactly once.
 func (s *otherScreen) send(triangles []*spec.Triangle) {
 	if s.chTriangles == nil {
 		for _, t := range triangles {
-			returnTriangle(t, s.chSelf)
+			returnTriangle(t, s.direction, s.chSelf)
 		}
 		return
 	}
@@ -245,9 +334,8 @@ func (s *otherScreen) send(triangles []*spec.Triangle) {
 		select {
 		case <-s.chLost:
 			// Lost the other screen, so reflect the remaining triangles back onto my screen.
-			for i < len(triangles) {
-				returnTriangle(t, s.chSelf)
-				i++
+			for _, t := range triangles[i:] {
+				returnTriangle(t, s.direction, s.chSelf)
 			}
 			return
 		case s.chTriangles <- t:
@@ -266,27 +354,88 @@ func touch2coords(t touch.Event, sz size.Event) (x, y float32) {
 	return 2*t.X/float32(sz.WidthPx) - 1, 1 - 2*t.Y/float32(sz.HeightPx)
 }
 
-func moveTriangle(t *spec.Triangle) {
-	t.Dy = t.Dy - gravity
-	t.X = t.X + t.Dx*timeBetweenPaints
-	t.Y = t.Y + t.Dy*timeBetweenPaints
-	if t.Y <= -1 {
-		t.Dy = -1 * t.Dy
-		t.Y = -1
-	} else if maxY := 1 - triangleCenterHeight; t.Y >= maxY {
-		t.Dy = -1 * t.Dy
-		t.Y = maxY
+// flickVelocity returns the velocity (in GL coordinates per second) of a
+// triangle dragged from (x0, y0) to (x1, y1) over duration d.
+func flickVelocity(x0, y0, x1, y1 float32, d time.Duration) (dx, dy float32) {
+	if d < minFlickDuration {
+		d = minFlickDuration
+	}
+	secs := float32(d.Seconds())
+	dx, dy = (x1-x0)/secs, (y1-y0)/secs
+	if speed := float32(math.Hypot(float64(dx), float64(dy))); speed > maxFlickSpeed {
+		dx, dy = dx*maxFlickSpeed/speed, dy*maxFlickSpeed/speed
+	}
+	return dx, dy
+}
+
+// spawnChoice returns the size and shape of a triangle spawned by a touch on
+// the top banner that was dragged by dx (in GL coordinates) along the banner
+// and held down for d.
+func spawnChoice(dx float32, d time.Duration) (size float32, shape spec.Shape) {
+	size = sim.DefaultSize * float32(math.Pow(2, float64(dx)))
+	switch {
+	case size < minSpawnSize:
+		size = minSpawnSize
+	case size > maxSpawnSize:
+		size = maxSpawnSize
+	}
+	if idx := int(d / spawnShapeHoldDuration); idx < len(spec.ShapeAll) {
+		return size, spec.ShapeAll[idx]
 	}
+	return size, spec.ShapeAll[len(spec.ShapeAll)-1]
 }
 
-func returnTriangle(t *spec.Triangle, myScreen chan<- *spec.Triangle) {
-	t.Dx = -1 * t.Dx
-	moveTriangle(t)
+// updateCandidates returns list with c added to it, or replacing the
+// candidate with the same Id, or removed from it if c is Lost.
+func updateCandidates(list []Candidate, c Candidate) []Candidate {
+	for i := range list {
+		if list[i].Id != c.Id {
+			continue
+		}
+		if c.Lost {
+			return append(list[:i], list[i+1:]...)
+		}
+		list[i] = c
+		return list
+	}
+	if c.Lost {
+		return list
+	}
+	return append(list, c)
+}
+
+// candidateTouched returns the candidate whose swatch contains (x, y), along
+// with the edge it is drawn on.
+func candidateTouched(candidates map[spec.Direction][]Candidate, x, y float32) (spec.Direction, Candidate, bool) {
+	for dir, list := range candidates {
+		if i := candidateAt(dir, len(list), x, y); i >= 0 {
+			return dir, list[i], true
+		}
+	}
+	return 0, Candidate{}, false
+}
+
+// returnTriangle reflects t, which went off the edge of my screen in
+// direction, back onto my screen.
+func returnTriangle(t *spec.Triangle, direction spec.Direction, myScreen chan<- *spec.Triangle) {
+	sim.Reflect(t, direction, sim.TimestepSeconds)
+	trace(t, "returned from the %v edge", direction)
 	myScreen <- t
 }
 
+// screenID identifies this screen as the Origin of the triangles it spawns.
+var screenID = uuid.New()
+
 const (
 	acceptInvitationDuration = time.Second
-	gravity                  = 0.001
-	timeBetweenPaints        = 0.1
+	// A touch that ends before maxTapDuration is considered a tap.
+	maxTapDuration = time.Second / 4
+	// Bounds on the velocity imparted by a touch that drags a triangle.
+	minFlickDuration = time.Second / 60
+	maxFlickSpeed    = 8 // GL coordinates per second
+	// Bounds on the size of triangles spawned from the top banner and the
+	// time for which the banner must be held down to pick the next shape.
+	minSpawnSize           = sim.DefaultSize / 4
+	maxSpawnSize           = sim.DefaultSize * 2
+	spawnShapeHoldDuration = time.Second / 2
 )
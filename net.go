@@ -2,22 +2,45 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/asimshankar/triangles/sim"
 	"github.com/asimshankar/triangles/spec"
+	"github.com/pborman/uuid"
+	"golang.org/x/mobile/event/size"
+	"io"
+	"log"
+	"math/rand"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
-	"v.io/v23"
-	"v.io/v23/context"
-	"v.io/v23/discovery"
-	"v.io/v23/options"
-	"v.io/v23/rpc"
-	"v.io/v23/security"
-	discutil "v.io/x/ref/lib/discovery"
-
-	_ "v.io/x/ref/runtime/factories/roaming"
 )
 
-var interfaceName = spec.ScreenDesc.PkgPath
+var (
+	flagInvite = flag.String("invite", "right", "Comma-separated list of directions (left, right, above, below) in which this screen invites other screens to stand")
+	flagRoom   = flag.String("room", "", "Name of the room this screen is in, screens only invite screens in the same room so that separate groups of screens on one network do not link up")
+	flagPick   = flag.Bool("pick", false, "Whether the user picks the screens to invite from the ones discovered, instead of inviting the first one that accepts")
+	flagRing   = flag.Bool("ring", false, "Whether the screens at both ends of a row of screens may link up, so that triangles leaving one end of the row enter it at the other")
+
+	// Screens advertise the version of spec they implement and only
+	// invite screens that advertise the same one, since the wire format
+	// of Triangle changes across versions.
+	specVersion = fmt.Sprint(spec.Version)
+
+	// Errors refusing invitations that the inviter may send again later:
+	// while this screen sends or considers another one, and when the
+	// inviter sent it before learning that it joined the row of this
+	// screen.
+	errBusy     = errors.New("thanks for the invite but I'm considering another one")
+	errStaleRow = errors.New("thanks for the invite but you joined my row since sending it")
+
+	errWithdrawn = errors.New("invitation withdrawn")
+)
 
 type NetworkChannels struct {
 	// When the network setup is complete, the Color to be used is written
@@ -25,279 +48,1037 @@ type NetworkChannels struct {
 	// do the channel.
 	// Exactly one item is written to the channel before it is closed.
 	Ready <-chan interface{}
-	// Clients read NewLeftScreen to get a channel on which they can send
-	// triangles to the screen on the left.
-	NewLeftScreen <-chan (chan<- *spec.Triangle)
-	// Clients read NewRightScreen to get a channel on which they can send
-	// triangles to the screen on the right.
-	NewRightScreen <-chan (chan<- *spec.Triangle)
+	// Clients read Neighbours to learn of screens adjacent to this one,
+	// and get a channel on which they can send triangles to them.
+	Neighbours <-chan Neighbour
 	// Invitations is where clients can read invitations received to join
-	// another screen on their right (our left). The response to the invitation
-	// is sent by writing to Invitation.Response.
+	// another screen. The response to the invitation is sent by writing
+	// to Invitation.Response.
 	Invitations <-chan Invitation
+	// While this screen invites another one, the pairing code that the
+	// user of the other screen should find on this one is written to
+	// Pairings, and written again with no Code once the other screen
+	// responds (see Invitation.Code).
+	Pairings <-chan Pairing
+	// With --pick, the screens that can be invited are written to
+	// Candidates as they are discovered, and written again with Lost set
+	// once they are gone or can no longer be invited. Screens are only
+	// invited once the user picks them with Pick.
+	Candidates <-chan Candidate
+	Pick       func(direction spec.Direction, id string)
+	// Resize should be called whenever the size of this screen changes,
+	// so that its geometry can be exchanged with other screens.
+	Resize func(size.Event)
+	// Align should be called with the position of the marker that the
+	// user lined up with the one on the neighbour in direction, along the
+	// edge shared with it (see spec.Screen.Align).
+	Align func(direction spec.Direction, marker float32)
+	// SetRoom moves this screen to another room (see --room), after which
+	// it only invites and is only invited by screens in that room. Screens
+	// it is already linked with stay linked. Only the web bridge calls it,
+	// native screens stay in the room given by --room.
+	SetRoom func(room string)
+	// Close should be called when this screen goes away, after which
+	// other screens can no longer find it or give triangles to it.
+	// Neighbours is closed once that has taken effect, clients should
+	// keep reading Neighbours and Invitations until then.
+	Close func()
+}
+
+// Neighbour is a screen adjacent to this one.
+type Neighbour struct {
+	Direction spec.Direction // Position of the neighbour relative to this screen
+	// Triangles is the channel on which triangles should be sent to the
+	// neighbour, nil if there no longer is a neighbour in Direction.
+	Triangles chan<- *spec.Triangle
+}
+
+// Pairing is the code to be displayed while this screen invites another one.
+type Pairing struct {
+	Direction spec.Direction // In which the other screen is invited to stand
+	Code      string         // Empty once the other screen responded
+}
+
+// Candidate is a screen discovered with --pick, which the user can invite to
+// stand next to this one.
+type Candidate struct {
+	Id        string         // Identifies the screen, see NetworkChannels.Pick
+	Direction spec.Direction // In which the screen would be invited to stand
+	Color     Color          // Identifying the screen
+	OS        string         // That the screen runs on, only labelled by the web client
+	Lost      bool
+}
+
+// SetupNetwork links this screen with others found over transport.
+func SetupNetwork(transport Transport, chMyScreen chan<- *spec.Triangle) NetworkChannels {
+	return setupNetwork(transport, *flagInvite, *flagRoom, chMyScreen)
 }
 
-func SetupNetwork(chMyScreen chan<- *spec.Triangle) NetworkChannels {
+// setupNetwork is SetupNetwork, inviting other screens to stand in the
+// directions listed in invite (in the format of --invite) and starting in
+// room.
+func setupNetwork(transport Transport, invite, room string, chMyScreen chan<- *spec.Triangle) NetworkChannels {
 	var (
-		ready          = make(chan interface{})
-		newLeftScreen  = make(chan chan<- *spec.Triangle)
-		newRightScreen = make(chan chan<- *spec.Triangle)
-		invites        = make(chan Invitation)
-		nm             = &networkManager{
+		ready      = make(chan interface{})
+		neighbours = make(chan Neighbour)
+		invites    = make(chan Invitation)
+		pairings   = make(chan Pairing)
+		candidates = make(chan Candidate)
+		id         = uuid.New()
+		nm         = &networkManager{
+			id:         id,
+			transport:  transport,
+			invite:     invite,
 			myScreen:   chMyScreen,
 			inviteRPCs: make(chan Invitation),
+			lost:       make(chan spec.Direction),
+			rooms:      make(chan string),
+			pairings:   pairings,
+			candidates: candidates,
+			picks:      make(map[spec.Direction]chan string),
+			recent:     newRecentTriangles(maxRecentTriangles),
+			closed:     make(chan struct{}),
+			neighbours: make(map[spec.Direction]*remoteScreen),
+			head:       id,
+			room:       room,
 		}
 		ret = NetworkChannels{
-			Ready:          ready,
-			NewLeftScreen:  newLeftScreen,
-			NewRightScreen: newRightScreen,
-			Invitations:    invites,
+			Ready:       ready,
+			Neighbours:  neighbours,
+			Invitations: invites,
+			Pairings:    pairings,
+			Candidates:  candidates,
+			Pick:        nm.pick,
+			Resize:      nm.resize,
+			Align:       nm.align,
+			SetRoom:     nm.setRoom,
+			Close:       nm.close,
 		}
 	)
-	go nm.run(ready, newLeftScreen, newRightScreen, invites)
+	for _, dir := range spec.DirectionAll {
+		nm.neighbours[dir] = &remoteScreen{direction: dir, transport: transport, myScreen: chMyScreen, notify: neighbours, lost: nm.lost}
+		nm.picks[dir] = make(chan string, 1)
+	}
+	go nm.run(ready, neighbours, invites)
 	return ret
 }
 
+// networkManager links this screen with the screens around it, using a
+// Transport to find and talk to them.
 type networkManager struct {
+	id         string // Identifies the row of screens while this one is the leftmost in it
+	key        string // Fingerprint of this screen, set by run once the transport started
+	transport  Transport
+	invite     string // Directions in which to invite other screens, see --invite
 	myScreen   chan<- *spec.Triangle
 	inviteRPCs chan Invitation
+	lost       chan spec.Direction // Directions of remote screens that were lost
+	rooms      chan string         // Rooms that this screen moved to
+	pairings   chan<- Pairing
+	candidates chan<- Candidate
+	picks      map[spec.Direction]chan string // Candidates picked by the user, by direction
+	neighbours map[spec.Direction]*remoteScreen
+	recent     *recentTriangles // Triangles recently taken from other screens
+	closed     chan struct{}    // Closed by close
+	closeOnce  sync.Once
+
+	mu       sync.Mutex
+	geometry spec.Geometry // Of this screen
+	head     string        // Identifies the row of screens this one belongs to, see spec.Screen.JoinRow
+	room     string        // See --room
+	inviting int           // Number of invitations this screen is sending
+}
+
+func (nm *networkManager) resize(e size.Event) {
+	g := geometry(e)
+	nm.mu.Lock()
+	changed := g != nm.geometry
+	nm.geometry = g
+	nm.mu.Unlock()
+	if !changed {
+		return
+	}
+	// Linked screens only learned the geometry of this one when they
+	// linked up with it.
+	for _, n := range nm.neighbours {
+		n.realign(g)
+	}
+}
+
+func (nm *networkManager) myGeometry() spec.Geometry {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.geometry
+}
+
+func (nm *networkManager) setRoom(room string) {
+	select {
+	case nm.rooms <- room:
+	case <-nm.closed:
+	}
+}
+
+// pick records that the user picked the candidate id to stand in direction,
+// replacing any earlier pick that was not acted upon yet.
+func (nm *networkManager) pick(direction spec.Direction, id string) {
+	ch := nm.picks[direction]
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- id:
+	default:
+	}
+}
+
+func (nm *networkManager) myRoom() string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.room
+}
+
+// setInviting records that this screen started (or, if delta is -1, finished)
+// sending an invitation.
+func (nm *networkManager) setInviting(delta int) {
+	nm.mu.Lock()
+	nm.inviting += delta
+	nm.mu.Unlock()
+}
+
+// busy returns true while this screen sends invitations, which it refuses
+// invitations during so that screens do not link up in a ring by inviting
+// each other at the same time.
+func (nm *networkManager) busy() bool {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.inviting > 0
+}
+
+// row returns the identifier of the row of screens this one belongs to.
+func (nm *networkManager) row() string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.head
 }
 
-func (nm *networkManager) run(ready chan<- interface{}, newLeftScreen, newRightScreen chan<- chan<- *spec.Triangle, newInvite chan<- Invitation) {
-	defer close(nm.myScreen)
-	defer close(newLeftScreen)
-	defer close(newRightScreen)
+// setRow records that the row of screens this one belongs to is identified
+// by head and, if that changed, passes it on to the screen on the right.
+func (nm *networkManager) setRow(head string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if nm.head == head {
+		return
+	}
+	nm.head = head
+	nm.neighbours[spec.DirectionRight].JoinRow(head)
+}
+
+func (nm *networkManager) align(direction spec.Direction, marker float32) {
+	nm.neighbours[direction].Align(marker, nm.myGeometry())
+}
+
+func (nm *networkManager) close() {
+	nm.closeOnce.Do(func() { close(nm.closed) })
+}
+
+func (nm *networkManager) run(ready chan<- interface{}, newNeighbour chan<- Neighbour, newInvite chan<- Invitation) {
+	defer close(newNeighbour)
 	notifyReady := func(result interface{}) {
 		ready <- result
 		close(ready)
 		ready = nil
 	}
-	ctx, shutdown := v23.Init()
-	defer shutdown()
-	ctx, server, err := v23.WithNewServer(ctx, "", spec.ScreenServer(nm), security.AllowEveryone())
+	inviteDirections, err := parseDirections(nm.invite)
 	if err != nil {
 		notifyReady(err)
 		return
 	}
-	disc, err := v23.NewDiscovery(ctx)
+	me, err := nm.transport.Start(nm)
 	if err != nil {
 		notifyReady(err)
 		return
 	}
-	// Select a color based on some unique identifier of the process, the PublicKey serves as one.
-	notifyReady(selectColor(v23.GetPrincipal(ctx).PublicKey()))
+	defer nm.transport.Stop()
+	nm.key = fingerprint(me.Id)
+	notifyReady(me.Color)
 	var (
-		left     = remoteScreen{myScreen: nm.myScreen, notify: newLeftScreen}
-		right    = remoteScreen{myScreen: nm.myScreen, notify: newRightScreen}
-		accepted = make(chan string) // Names of remote screens that accepted an invitation
-		seek     = make(chan bool)   // Send false to stop seeking invitations from others, true otherwise
+		neighbours = nm.neighbours
+		accepted   = make(chan invitee) // Remote screens that accepted an invitation
+		seek       = make(chan bool)    // Send false to stop seeking invitations from others, true otherwise
+		seeking    = true
+		stopInvite = make(chan struct{}) // Closed to stop sending invitations to the current room
 
 		pendingInviterName        string
+		pendingInviterId          string
+		pendingInviterDirection   spec.Direction
+		pendingInviterGeometry    spec.Geometry
+		pendingInviterRow         string
 		pendingInviteUserResponse <-chan error
 		pendingInviteRPCResponse  chan<- error
+		pendingInviteWithdrawn    <-chan struct{}
+
+		// Seek invitations from others as long as there is room for
+		// another neighbour.
+		updateSeek = func() {
+			free := false
+			for _, n := range neighbours {
+				if !n.Active() {
+					free = true
+				}
+			}
+			if free != seeking {
+				seeking = free
+				seek <- free
+			}
+		}
+
+		// Invite another screen to stand in direction, in the
+		// current room.
+		invite = func(direction spec.Direction) {
+			if *flagPick {
+				go nm.pickInvites(direction, nm.myRoom(), stopInvite, accepted)
+				return
+			}
+			go nm.sendInvites(direction, nm.myRoom(), stopInvite, accepted)
+		}
+
+		clearPendingInvite = func() {
+			pendingInviterName = ""
+			pendingInviterId = ""
+			pendingInviterRow = ""
+			pendingInviteUserResponse = nil
+			pendingInviteRPCResponse = nil
+			pendingInviteWithdrawn = nil
+		}
+
+		activate = func(direction spec.Direction, name, id string, geometry spec.Geometry) {
+			log.Printf("Activating %v screen %q with geometry %+v", direction, name, geometry)
+			neighbours[direction].Activate(name, id, geometry)
+			if direction == spec.DirectionRight {
+				// The screen on the right now belongs to the row of
+				// this one.
+				neighbours[direction].JoinRow(nm.row())
+			}
+			updateSeek()
+		}
 	)
-	seekInvites(ctx, disc, server, seek)
-	go sendInvites(ctx, disc, accepted)
+	defer func() { close(stopInvite) }()
+	seekInvites(nm.transport, me, nm.id, nm.myRoom, seek)
+	for _, dir := range inviteDirections {
+		invite(dir)
+	}
 	for {
 		select {
 		case invitation := <-nm.inviteRPCs:
-			if left.Active() {
-				invitation.Response <- fmt.Errorf("thanks for the invite but I'm already engaged with a previous invitation")
+			if pendingInviteUserResponse != nil || nm.busy() {
+				invitation.Response <- errBusy
+				break
+			}
+			if neighbours[invitation.Direction].Active() {
+				invitation.Response <- fmt.Errorf("thanks for the invite but I already have a screen on my %v", invitation.Direction)
+				break
+			}
+			if invitation.Row == nm.row() && !(*flagRing && (invitation.Direction == spec.DirectionLeft || invitation.Direction == spec.DirectionRight)) {
+				// Accepting would link the screens at both ends
+				// of the row, or stack screens in it.
+				invitation.Response <- fmt.Errorf("thanks for the invite but I already belong to your row")
+				break
+			}
+			if invitation.Row != nm.row() && nm.linkedTo(invitation.Id) {
+				// The inviter sent the invitation before learning
+				// that it joined the row of this screen, accepting
+				// would close the row into a ring of two screens.
+				invitation.Response <- errStaleRow
 				break
 			}
 			// Defer the response to the user interface.
-			ch := make(chan error)
+			invitation.Code = pairingCode(nm.key, fingerprint(invitation.Id))
+			// Buffered so that the user interface does not block if it
+			// responds after the invitation has been withdrawn.
+			ch := make(chan error, 1)
 			pendingInviterName = invitation.Name
+			pendingInviterId = invitation.Id
+			pendingInviterDirection = invitation.Direction
+			pendingInviterGeometry = invitation.Geometry
+			pendingInviterRow = invitation.Row
 			pendingInviteRPCResponse = invitation.Response
 			pendingInviteUserResponse = ch
+			pendingInviteWithdrawn = invitation.Withdrawn
 			invitation.Response = ch
 			newInvite <- invitation
 		case err := <-pendingInviteUserResponse:
+			if err == nil {
+				// The inviter may give triangles as soon as it learns
+				// of the response.
+				neighbours[pendingInviterDirection].expect(pendingInviterId)
+				if pendingInviterDirection == spec.DirectionLeft {
+					// Join the row of the inviter before it calls
+					// JoinRow, so that invitations that this screen
+					// sends in the meantime carry it.
+					nm.setRow(pendingInviterRow)
+				}
+			}
 			pendingInviteRPCResponse <- err
 			if err == nil {
-				ctx.Infof("Activating left screen %q", pendingInviterName)
-				left.Activate(ctx, pendingInviterName)
+				activate(pendingInviterDirection, pendingInviterName, pendingInviterId, pendingInviterGeometry)
+			}
+			clearPendingInvite()
+		case <-pendingInviteWithdrawn:
+			// The user interface need not respond to a withdrawn
+			// invitation, refuse it on its behalf so that the inviter
+			// returns and this screen considers the next one.
+			log.Printf("Invitation from %q withdrawn", pendingInviterName)
+			pendingInviteRPCResponse <- errWithdrawn
+			clearPendingInvite()
+		case dir := <-nm.lost:
+			log.Printf("Deactivating %v screen", dir)
+			neighbours[dir].Deactivate()
+			updateSeek()
+			if dir == spec.DirectionLeft {
+				// This screen is now the leftmost in its row.
+				nm.setRow(nm.id)
+			}
+			for _, d := range inviteDirections {
+				if d == dir {
+					invite(dir)
+				}
+			}
+		case room := <-nm.rooms:
+			if room == nm.myRoom() {
+				break
+			}
+			log.Printf("Moving to room %q", room)
+			nm.mu.Lock()
+			nm.room = room
+			nm.mu.Unlock()
+			// Start over with the screens in the new room.
+			close(stopInvite)
+			stopInvite = make(chan struct{})
+			for _, dir := range inviteDirections {
+				if !neighbours[dir].Active() {
+					invite(dir)
+				}
+			}
+			if seeking {
 				seek <- false
+				seek <- true
 			}
-			pendingInviterName = ""
-			pendingInviteUserResponse = nil
-			pendingInviteRPCResponse = nil
-		case <-left.Lost():
-			ctx.Infof("Deactivating left screen")
-			left.Deactivate()
-			seek <- true
-		case invitee := <-accepted:
-			ctx.Infof("Activating right screen %q", invitee)
-			right.Activate(ctx, invitee)
-		case <-right.Lost():
-			ctx.Infof("Deactivating right screen")
-			right.Deactivate()
-			go sendInvites(ctx, disc, accepted)
-		case <-ctx.Done():
+		case <-nm.closed:
+			log.Printf("Screen closed, no longer linking it with others")
 			return
+		case invitee := <-accepted:
+			if n := neighbours[invitee.Direction]; n.Active() {
+				// Another screen invited us to stand next to it in the meantime.
+				log.Printf("Ignoring %q, which accepted an invitation to be on my %v after another screen took its place", invitee.Name, invitee.Direction)
+				break
+			}
+			activate(invitee.Direction, invitee.Name, invitee.Id, invitee.Geometry)
 		}
 	}
 }
 
 type remoteScreen struct {
-	lost <-chan error // State changed by activate/deactivate
+	active  bool          // State changed by activate/deactivate
+	stopped chan struct{} // Closed by deactivate, see channel2rpc
 	// State fixed at construction time
-	myScreen chan<- *spec.Triangle
-	notify   chan<- chan<- *spec.Triangle
+	direction spec.Direction
+	transport Transport
+	myScreen  chan<- *spec.Triangle
+	notify    chan<- Neighbour
+	lost      chan<- spec.Direction
+
+	// The link with the remote screen, changed by activate/deactivate and
+	// Align and read by RPCs from the remote screen.
+	mu         sync.Mutex
+	name       string
+	id         string        // Identifies the remote screen, see Peer.Id
+	geometry   spec.Geometry // Of the remote screen
+	marker     float32       // Position of the marker on this screen, along the shared edge
+	peerMarker float32       // Position of the marker on the remote screen, along the shared edge
 }
 
-func (s *remoteScreen) Active() bool       { return s.lost != nil }
-func (s *remoteScreen) Lost() <-chan error { return s.lost }
-func (s *remoteScreen) Activate(ctx *context.T, name string) {
+func (s *remoteScreen) Active() bool { return s.active }
+func (s *remoteScreen) Activate(name, id string, geometry spec.Geometry) {
+	s.active = true
+	s.mu.Lock()
+	s.name, s.id, s.geometry, s.marker, s.peerMarker = name, id, geometry, 0, 0
+	s.mu.Unlock()
 	errch := make(chan error)
-	s.lost = errch
+	go func() {
+		if err := <-errch; err != nil {
+			s.lost <- s.direction
+		}
+	}()
 	ch := make(chan *spec.Triangle)
-	go channel2rpc(ctx, ch, name, errch, s.myScreen)
-	s.notify <- ch
+	s.stopped = make(chan struct{})
+	go channel2rpc(s.transport, ch, s.stopped, name, s.direction, errch, s.myScreen)
+	s.notify <- Neighbour{Direction: s.direction, Triangles: ch}
 }
 func (s *remoteScreen) Deactivate() {
-	s.lost = nil
-	s.notify <- nil
+	s.active = false
+	s.mu.Lock()
+	s.name, s.id = "", ""
+	s.mu.Unlock()
+	s.notify <- Neighbour{Direction: s.direction}
+	// Once notified, the user interface stops sending triangles to the
+	// remote screen (see otherScreen.send).
+	close(s.stopped)
+}
+
+// Align records the position of the marker on this screen and informs the
+// remote screen of it, along with the geometry of this screen.
+func (s *remoteScreen) Align(marker float32, geometry spec.Geometry) {
+	s.mu.Lock()
+	s.marker = marker
+	name := s.name
+	s.mu.Unlock()
+	if len(name) == 0 {
+		return
+	}
+	go func() {
+		cancel, stop := deadline(maxAlignTime)
+		defer stop()
+		if err := s.transport.Align(name, opposite(s.direction), marker, geometry, cancel); err != nil {
+			log.Printf("%q.Align failed: %v", name, err)
+		}
+	}()
+}
+
+// realign informs the remote screen of the new geometry of this screen,
+// along with the position of the marker on it.
+func (s *remoteScreen) realign(geometry spec.Geometry) {
+	s.mu.Lock()
+	marker := s.marker
+	s.mu.Unlock()
+	s.Align(marker, geometry)
+}
+
+// JoinRow informs the remote screen, which stands on the right of this one,
+// that the row of screens this one belongs to is identified by head.
+func (s *remoteScreen) JoinRow(head string) {
+	s.mu.Lock()
+	name := s.name
+	s.mu.Unlock()
+	if len(name) == 0 {
+		return
+	}
+	go func() {
+		cancel, stop := deadline(maxJoinRowTime)
+		defer stop()
+		if err := s.transport.JoinRow(name, head, cancel); err != nil {
+			log.Printf("%q.JoinRow failed: %v", name, err)
+		}
+	}()
+}
+
+// linked returns true if there is a remote screen.
+func (s *remoteScreen) linked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.name) > 0
+}
+
+// expect records that the screen identified by id accepted an invitation to
+// be the remote screen, so that it may give triangles before it is activated.
+// It does nothing if there is a remote screen already.
+func (s *remoteScreen) expect(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.name) == 0 {
+		s.id = id
+	}
+}
+
+// linkedTo returns true if the screen identified by id is the remote screen,
+// or is expected to be.
+func (s *remoteScreen) linkedTo(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(id) > 0 && s.id == id
+}
+
+// seam returns the geometry of the remote screen and the positions of the
+// markers on both screens.
+func (s *remoteScreen) seam() (geometry spec.Geometry, marker, peerMarker float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.geometry, s.marker, s.peerMarker
+}
+
+// setPeerSeam records the position of the marker on the remote screen and
+// the geometry of that screen, returning false if there is no remote screen.
+func (s *remoteScreen) setPeerSeam(marker float32, geometry spec.Geometry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.name) == 0 {
+		return false
+	}
+	s.peerMarker, s.geometry = marker, geometry
+	return true
+}
+
+// invitee is a remote screen that accepted an invitation.
+type invitee struct {
+	Name      string
+	Id        string         // Identifies the invitee, see Peer.Id
+	Direction spec.Direction // Position of the invitee relative to this screen
+	Geometry  spec.Geometry  // Of the invitee
 }
 
 type Invitation struct {
 	Name      string
+	Id        string // Identifies the inviter, see Peer.Id
 	Color     Color
+	Direction spec.Direction // Position of the inviter relative to this screen
+	Geometry  spec.Geometry  // Of the inviter
+	Row       string         // Identifies the row of screens of the inviter
+	// Code is the pairing code of the inviter and this screen, which the
+	// inviter displays too (see NetworkChannels.Pairings). The user should
+	// only accept the invitation after confirming that it does, so as not
+	// to link up with another screen than the one they meant to.
+	Code      string
 	Response  chan<- error
-	Withdrawn <-chan struct{} // Close if the invitation has been withdrawn
+	Withdrawn <-chan struct{} // Closed if the invitation has been withdrawn, Response is ignored then
+}
+
+func (nm *networkManager) Invite(caller Peer, direction spec.Direction, geometry spec.Geometry, row string, withdrawn <-chan struct{}) (spec.Geometry, error) {
+	var (
+		response   = make(chan error)
+		invitation = Invitation{
+			Name:      caller.Name,
+			Id:        caller.Id,
+			Color:     caller.Color,
+			Direction: opposite(direction),
+			Geometry:  geometry,
+			Row:       row,
+			Response:  response,
+			Withdrawn: withdrawn,
+		}
+	)
+	select {
+	case nm.inviteRPCs <- invitation:
+	case <-nm.closed:
+		return spec.Geometry{}, errScreenClosed
+	}
+	select {
+	case err := <-response:
+		if err != nil {
+			return spec.Geometry{}, err
+		}
+	case <-nm.closed:
+		return spec.Geometry{}, errScreenClosed
+	}
+	return nm.myGeometry(), nil
 }
 
-func (nm *networkManager) Invite(ctx *context.T, call rpc.ServerCall) error {
-	inviter := call.RemoteEndpoint().Name()
-	response := make(chan error)
-	nm.inviteRPCs <- Invitation{
-		Name:      inviter,
-		Color:     selectColor(call.Security().RemoteBlessings().PublicKey()),
-		Response:  response,
-		Withdrawn: ctx.Done(),
+func (nm *networkManager) Give(caller Peer, triangles []spec.Triangle) error {
+	if !caller.Trusted && !nm.linkedTo(caller.Id) {
+		return fmt.Errorf("%v is not linked with this screen", caller.Name)
 	}
-	if err := <-response; err != nil {
-		return err
+	for i := range triangles {
+		nm.take(&triangles[i])
 	}
-	blessings, rejected := security.RemoteBlessingNames(ctx, call.Security())
-	ctx.Infof("Accepted invitation from %v@%v (rejected blessings: %v)", blessings, inviter, rejected)
 	return nil
 }
 
-func (nm *networkManager) Give(ctx *context.T, call rpc.ServerCall, t spec.Triangle) error {
-	if ctx.V(3) {
-		blessings, rejected := security.RemoteBlessingNames(ctx, call.Security())
-		ctx.Infof("Took a triangle from %v@%v (rejected blessings: %v)", blessings, call.RemoteEndpoint().Name(), rejected)
+// linkedTo returns true if the screen identified by id is linked with this
+// one, on any side.
+func (nm *networkManager) linkedTo(id string) bool {
+	for _, n := range nm.neighbours {
+		if n.linkedTo(id) {
+			return true
+		}
 	}
+	return false
+}
+
+// take transforms t, given by another screen, to the coordinates of this
+// screen and adds it to this screen, unless it has been taken already.
+func (nm *networkManager) take(t *spec.Triangle) {
+	if !nm.recent.add(t) {
+		trace(t, "dropped duplicate")
+		return
+	}
+	t.Hops++
 	// Transform from sender's coordinates to our coordinates.
 	// The assumption is that if the triangle was to the left of the
 	// sender's coordinate system, then it will appear on our right and
-	// vice-versa.
+	// vice-versa (and similarly for above and below).
+	var exit spec.Direction // Edge of the sender's screen that the triangle went off
 	switch {
 	case t.X < -1:
-		t.X += 2
+		exit = spec.DirectionLeft
 	case t.X > 1:
-		t.X -= 2
+		exit = spec.DirectionRight
+	case t.Y < -1:
+		exit = spec.DirectionBelow
+	default:
+		exit = spec.DirectionAbove
+	}
+	// Triangles given by screens that are not adjacent to this one are
+	// transformed as if they were, with centers aligned.
+	peer, marker, peerMarker := nm.neighbours[opposite(exit)].seam()
+	sim.Handoff(t, exit, peer, nm.myGeometry(), peerMarker, marker)
+	trace(t, "taken from the screen on my %v", opposite(exit))
+	select {
+	case nm.myScreen <- t:
+	case <-nm.closed:
+		// Lost along with the rest of the triangles on this screen.
 	}
-	nm.myScreen <- &t
+}
+
+func (nm *networkManager) Align(caller Peer, side spec.Direction, marker float32, geometry spec.Geometry) error {
+	if !nm.neighbours[side].setPeerSeam(marker, geometry) {
+		return fmt.Errorf("there is no screen on my %v", side)
+	}
+	log.Printf("Screen on my %v aligned its marker at %v, with geometry %+v", side, marker, geometry)
 	return nil
 }
 
-func sendInvites(ctx *context.T, disc discovery.T, notify chan<- string) {
-	ctx.Infof("Scanning for peers to invite")
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	updates, err := disc.Scan(ctx, fmt.Sprintf("v.InterfaceName=%q", interfaceName))
-	if err != nil {
-		ctx.Panic(err)
+func (nm *networkManager) JoinRow(caller Peer, head string) error {
+	if !nm.neighbours[spec.DirectionLeft].linked() {
+		return fmt.Errorf("there is no screen on my %v", spec.DirectionLeft)
 	}
-	for u := range updates {
-		if u.IsLost() {
-			continue
+	if head == nm.id {
+		// The row is a ring and head went all the way around it, there
+		// is no one left to pass it on to.
+		if !*flagRing {
+			log.Printf("Screens invited each other at the same time and linked up in a ring")
 		}
-		ctx.Infof("Sending invitations to %+v", u.Addresses())
-		if addr := sendOneInvite(ctx, u.Addresses()); len(addr) > 0 {
-			notify <- addr
+		nm.mu.Lock()
+		nm.head = head
+		nm.mu.Unlock()
+		return nil
+	}
+	nm.setRow(head)
+	return nil
+}
+
+// sendInvites invites the first peer in room that accepts to stand in
+// direction of this screen. Peers that refuse because they are considering
+// another invitation are invited again every inviteRetryInterval while they
+// are in room.
+//
+// With --ring, the leftmost screen in the row of this one is only invited
+// once no other peer is left to invite, so that the row does not close into a
+// ring before every screen joined it. It is invited again until it accepts,
+// closing the ring (or as long as it refuses with errStaleRow, since the
+// row of this screen may not have been up to date). sendInvites gives up when
+// stop is closed.
+//
+// The row of a screen reaches it one screen at a time (see JoinRow), so in a
+// row of more than three screens the rightmost one may still invite the
+// leftmost one before learning that it is, closing the ring early.
+func (nm *networkManager) sendInvites(direction spec.Direction, room string, stop <-chan struct{}, notify chan<- invitee) {
+	log.Printf("Scanning for peers in room %q to invite to my %v", room, direction)
+	cancel := make(chan struct{})
+	defer close(cancel)
+	updates, err := nm.transport.Scan(map[string]string{versionAttribute: specVersion, roomAttribute: room}, cancel)
+	if err != nil {
+		log.Panic(err)
+	}
+	var (
+		busy     = make(map[string]PeerUpdate) // Peers to invite again, by Id
+		deferred = make(map[string]PeerUpdate) // Peers to invite once busy is empty, by Id
+		retry    <-chan time.Time              // Fires when it is time to invite busy and deferred peers
+		drain    = func() {
 			go func() {
 				for range updates {
 				}
 			}()
+		}
+		// invite invites u and returns true if it accepted. Unless
+		// closing, the leftmost screen in the row of this one is
+		// deferred instead.
+		invite = func(u PeerUpdate, closing bool) bool {
+			// The invitation carries the row checked here, even if
+			// this screen joins the row of u meanwhile, so that u
+			// does not take it for one closing the ring.
+			row := nm.row()
+			if !closing && *flagRing && u.Attributes[headAttribute] == row {
+				log.Printf("Deferring invitations to %+v, which is leftmost in my row", u.Addresses)
+				deferred[u.Id] = u
+				return false
+			}
+			log.Printf("Sending invitations to %+v", u.Addresses)
+			inv, err := nm.invitePeer(direction, u, row)
+			switch err {
+			case errBusy:
+				busy[u.Id] = u
+			case errStaleRow:
+				deferred[u.Id] = u
+			}
+			if err != nil {
+				return false
+			}
+			select {
+			case notify <- inv:
+			case <-nm.closed:
+			}
+			drain()
+			return true
+		}
+	)
+	for updates != nil || len(busy) > 0 || len(deferred) > 0 {
+		if retry == nil && (len(busy) > 0 || len(deferred) > 0) {
+			retry = retryAfter()
+		}
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				updates = nil
+				break
+			}
+			if u.Lost {
+				delete(busy, u.Id)
+				delete(deferred, u.Id)
+				break
+			}
+			if invite(u, false) {
+				return
+			}
+		case <-retry:
+			retry = nil
+			peers, closing := busy, len(busy) == 0
+			if closing {
+				peers, deferred = deferred, make(map[string]PeerUpdate)
+			}
+			busy = make(map[string]PeerUpdate)
+			for _, u := range peers {
+				if invite(u, closing) {
+					return
+				}
+			}
+		case <-stop:
+			log.Printf("Stopped scanning for peers in room %q to invite to my %v", room, direction)
+			if updates != nil {
+				drain()
+			}
+			return
+		}
+	}
+	log.Printf("Stopped scanning for peers to invite without finding one")
+}
+
+// pickInvites is sendInvites for --pick: instead of inviting the peers in
+// room that it discovers, it offers them to the user as Candidates and invites
+// the ones that the user picks, until one of them accepts.
+func (nm *networkManager) pickInvites(direction spec.Direction, room string, stop <-chan struct{}, notify chan<- invitee) {
+	log.Printf("Scanning for peers in room %q for the user to invite to my %v", room, direction)
+	cancel := make(chan struct{})
+	defer close(cancel)
+	updates, err := nm.transport.Scan(map[string]string{versionAttribute: specVersion, roomAttribute: room}, cancel)
+	if err != nil {
+		log.Panic(err)
+	}
+	var (
+		peers = make(map[string]PeerUpdate) // Candidates offered to the user, by Id
+		picks = nm.picks[direction]
+		again string           // Picked by the user, but busy
+		retry <-chan time.Time // Fires when it is time to invite again
+		offer = func(c Candidate) {
+			select {
+			case nm.candidates <- c:
+			case <-nm.closed:
+			}
+		}
+		// invite invites the candidate id and returns true if it
+		// accepted.
+		invite = func(id string) bool {
+			u, ok := peers[id]
+			if !ok {
+				log.Printf("Ignoring %q, which the user picked after it was lost", id)
+				return false
+			}
+			log.Printf("Sending invitations to %+v, picked by the user", u.Addresses)
+			inv, err := nm.invitePeer(direction, u, nm.row())
+			if err == errBusy {
+				again, retry = id, retryAfter()
+			}
+			if err != nil {
+				return false
+			}
+			select {
+			case notify <- inv:
+			case <-nm.closed:
+			}
+			return true
+		}
+	)
+	defer func() {
+		for id := range peers {
+			offer(Candidate{Id: id, Direction: direction, Lost: true})
+		}
+		go func() {
+			for range updates {
+			}
+		}()
+	}()
+	// Forget what the user picked before these candidates were offered.
+	select {
+	case <-picks:
+	default:
+	}
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				log.Printf("Stopped scanning for peers to invite without finding one")
+				return
+			}
+			if u.Lost {
+				if _, ok := peers[u.Id]; ok {
+					delete(peers, u.Id)
+					offer(Candidate{Id: u.Id, Direction: direction, Lost: true})
+				}
+				continue
+			}
+			peers[u.Id] = u
+			offer(Candidate{Id: u.Id, Direction: direction, Color: parseColor(u.Attributes[colorAttribute]), OS: u.Attributes[osAttribute]})
+		case id := <-picks:
+			retry = nil
+			if invite(id) {
+				return
+			}
+		case <-retry:
+			retry = nil
+			if invite(again) {
+				return
+			}
+		case <-stop:
+			log.Printf("Stopped scanning for peers in room %q to invite to my %v", room, direction)
 			return
 		}
 	}
-	ctx.Infof("Stopped scanning for peers to invite without finding one")
 }
 
-// sendOneInvite sends invitations to all the addresses in addrs and returns the one that accepted it.
+// retryAfter returns a channel that fires when it is time to invite a screen
+// again after it refused with errBusy. The interval varies around
+// inviteRetryInterval, so that screens refused for inviting each other at the
+// same time do not keep doing so.
+func retryAfter() <-chan time.Time {
+	return time.After(inviteRetryInterval/2 + time.Duration(rand.Int63n(int64(inviteRetryInterval))))
+}
+
+// invitePeer invites the screen advertised in u to stand in direction of this
+// one, which is in row, and returns it if it accepts. The pairing code of both screens is
+// displayed until it responds.
+func (nm *networkManager) invitePeer(direction spec.Direction, u PeerUpdate, row string) (invitee, error) {
+	key := u.Attributes[keyAttribute]
+	nm.setInviting(1)
+	defer nm.setInviting(-1)
+	nm.pair(Pairing{Direction: direction, Code: pairingCode(nm.key, key)})
+	defer nm.pair(Pairing{Direction: direction})
+	peer, g, err := sendOneInvite(nm.transport, u.Addresses, direction, nm.myGeometry(), row)
+	if err != nil {
+		return invitee{}, err
+	}
+	if fingerprint(peer.Id) != key {
+		// Its user confirmed another code than the one displayed here.
+		log.Printf("Ignoring %q, which accepted an invitation to be on my %v but does not have the advertised fingerprint %v", peer.Name, direction, key)
+		return invitee{}, fmt.Errorf("%q does not have the advertised fingerprint %v", peer.Name, key)
+	}
+	// It may give triangles before run activates it.
+	nm.neighbours[direction].expect(peer.Id)
+	return invitee{Name: peer.Name, Id: peer.Id, Direction: direction, Geometry: g}, nil
+}
+
+// pair notifies the user interface of a change to the pairing code displayed
+// while this screen invites another one.
+func (nm *networkManager) pair(p Pairing) {
+	select {
+	case nm.pairings <- p:
+	case <-nm.closed:
+	}
+}
+
+// sendOneInvite sends invitations to all the addresses in addrs and returns the screen that accepted it,
+// along with its geometry, or an error if none did (errBusy or errStaleRow if any of them refused with it).
 // All addrs are assumed to be equivalent and thus at most one Invite RPC will succeed.
 //
 // TODO: This is aiming to replicate what the RPC stack does for all the
 // addresses a single name resolved to. Should all these addresses discovered
 // somehow be encapsulated in a single object name?
-func sendOneInvite(ctx *context.T, addrs []string) string {
+func sendOneInvite(transport Transport, addrs []string, direction spec.Direction, geometry spec.Geometry, row string) (Peer, spec.Geometry, error) {
 	// Give at most 1 second for these connections to be made, if they
 	// can't be made then consider the peer bad and ignore it.
 	// TODO: Should these RPCs also use the "connection timeout" that might be implemented
 	// as per proposal: https://docs.google.com/a/google.com/document/d/1prtxGhSR5TaL0lc_iDRC0Q6H1Drbg2T0x7MWVb_ZCSM/edit?usp=sharing
-	ctx, cancel := context.WithTimeout(ctx, maxInvitationWaitTime)
-	defer cancel()
-	ch := make(chan string)
+	cancel, stop := deadline(maxInvitationWaitTime)
+	defer stop()
+	type accepted struct {
+		peer     Peer
+		geometry spec.Geometry
+		err      error
+	}
+	ch := make(chan accepted)
 	for _, addr := range addrs {
 		go func(addr string) {
-			err := spec.ScreenClient(addr).Invite(ctx, options.ServerAuthorizer{security.AllowEveryone()})
-			ctx.Infof("Invitation to %v sent, error: %v", addr, err)
+			peer, g, err := transport.Invite(addr, direction, geometry, row, cancel)
+			log.Printf("Invitation to %v sent, error: %v", addr, err)
 			if err == nil {
-				ch <- addr
+				ch <- accepted{peer: peer, geometry: g}
 				return
 			}
-			ch <- ""
+			ch <- accepted{err: err}
 		}(addr)
 	}
+	err := fmt.Errorf("no addresses to invite")
 	for i := range addrs {
-		if ret := <-ch; len(ret) > 0 {
+		ret := <-ch
+		if len(ret.peer.Name) > 0 {
 			// Drain the rest and return
 			go func() {
-				i++
-				for i < len(addrs) {
+				for j := i + 1; j < len(addrs); j++ {
 					<-ch
 				}
 			}()
-			return ret
+			return ret.peer, ret.geometry, nil
+		}
+		// The error may have been wrapped by the Transport.
+		for _, e := range []error{errBusy, errStaleRow} {
+			if strings.Contains(ret.err.Error(), e.Error()) {
+				ret.err = e
+			}
+		}
+		if ret.err == errBusy || ret.err == errStaleRow || (err != errBusy && err != errStaleRow) {
+			err = ret.err
 		}
 	}
-	return ""
+	return Peer{}, spec.Geometry{}, err
 }
 
-func seekInvites(ctx *context.T, disc discovery.T, server rpc.Server, updates <-chan bool) {
+// seekInvites makes this screen, identified by me and heading the row head
+// while it is the leftmost in it, discoverable by screens in room() that send
+// invitations, as long as the last value received on updates is true.
+func seekInvites(transport Transport, me Peer, head string, room func() string, updates <-chan bool) {
 	var (
-		ad = &discovery.Advertisement{
-			InterfaceName: interfaceName,
-			Attributes: discovery.Attributes{
-				"OS": runtime.GOOS,
-			},
-		}
-		cancel    func()
-		chStopped <-chan struct{}
-		start     = func() {
-			// Start the advertisement, update cancelCtx, cancel and chStopped
+		attributes      map[string]string
+		stopAdvertising func()
+		start           = func() {
+			attributes = map[string]string{
+				osAttribute:      runtime.GOOS,
+				versionAttribute: specVersion,
+				roomAttribute:    room(),
+				colorAttribute:   formatColor(me.Color),
+				keyAttribute:     fingerprint(me.Id),
+				headAttribute:    head,
+			}
 			var err error
-			var advCtx *context.T
-			advCtx, cancel = context.WithCancel(ctx)
-			if chStopped, err = discutil.AdvertiseServer(advCtx, disc, server, "", ad, nil); err != nil {
-				cancel()
-				ctx.Infof("Failed to advertise %#v: %v", *ad, err)
+			if stopAdvertising, err = transport.Advertise(attributes); err != nil {
+				log.Printf("Failed to advertise %v: %v", attributes, err)
 				return
 			}
-			ctx.Infof("Started advertising: %#v", *ad)
+			log.Printf("Started advertising: %v", attributes)
 		}
 		stop = func() {
-			if chStopped == nil {
+			if stopAdvertising == nil {
 				return
 			}
-			cancel()
-			<-chStopped
-			ctx.Infof("Stopped advertising: %#v", *ad)
-			chStopped = nil
+			stopAdvertising()
+			log.Printf("Stopped advertising: %v", attributes)
+			stopAdvertising = nil
 		}
 	)
 	start()
@@ -312,30 +1093,243 @@ func seekInvites(ctx *context.T, disc discovery.T, server rpc.Server, updates <-
 	}()
 }
 
-func channel2rpc(ctx *context.T, src <-chan *spec.Triangle, dst string, errch chan<- error, myScreen chan<- *spec.Triangle) {
-	for t := range src {
-		// This is an "interactive" game, if an RPC doesn't succeed in say
-		ctxTimeout, cancel := context.WithTimeout(ctx, maxTriangleGiveTime)
-		if err := spec.ScreenClient(dst).Give(ctxTimeout, *t, options.ServerAuthorizer{security.AllowEveryone()}); err != nil {
-			cancel()
-			returnTriangle(t, myScreen)
-			ctx.Infof("%q.Give failed: %v, aborting connection with remote screen", dst, err)
-			errch <- err
-			break
+// channel2rpc gives the triangles received on src to the remote screen dst
+// over a single GiveAll stream.
+//
+// Triangles that arrive while the stream is busy are sent together in one
+// batch, and at most maxUnackedBatches batches are sent before the remote
+// screen acknowledges them. If the stream fails, or the remote screen does
+// not acknowledge a batch within maxTriangleGiveTime, the error is written to
+// errch and the triangles that were not acknowledged (as well as those
+// received on src thereafter) are returned to myScreen.
+//
+// Thus every triangle received on src is acknowledged by the remote screen or
+// returned to myScreen, but not necessarily only one of the two: a batch that
+// the remote screen took but whose acknowledgement never arrived is returned
+// too, so ends up on both screens.
+//
+// channel2rpc returns once src is closed or, after an error, once stopped is
+// closed by the owner of src to signal that it no longer sends on it.
+func channel2rpc(transport Transport, src <-chan *spec.Triangle, stopped <-chan struct{}, dst string, direction spec.Direction, errch chan<- error, myScreen chan<- *spec.Triangle) {
+	var (
+		cancel  = make(chan struct{})                 // Closed to abort the stream
+		unacked [][]*spec.Triangle                    // Batches sent but not yet acknowledged, oldest first
+		acks    = make(chan int32, maxUnackedBatches) // Closed once the stream yields no more acknowledgements
+		ackErr  = make(chan error, 1)
+		timeout <-chan time.Time // Fires if the oldest batch in unacked is not acknowledged in time
+		in      = src            // nil while there are too many unacked batches
+		open    = true           // false once src has been closed
+	)
+	stream, err := transport.GiveAll(dst, cancel)
+	if err == nil {
+		// acks is buffered so that this goroutine never blocks on an
+		// acknowledgement while the loop below blocks on stream.Send,
+		// which could otherwise wait on the remote screen to deliver
+		// the very same acknowledgement.
+		go func() {
+			defer close(acks)
+			for {
+				n, err := stream.Recv()
+				if err == io.EOF {
+					err = fmt.Errorf("stream closed by the remote screen")
+				}
+				if err != nil {
+					ackErr <- err
+					return
+				}
+				select {
+				case acks <- n:
+				case <-cancel:
+					return
+				}
+			}
+		}()
+	} else {
+		close(acks)
+	}
+	for err == nil && (open || len(unacked) > 0) {
+		select {
+		case t, ok := <-in:
+			if !ok {
+				open = false
+				break
+			}
+			// Send all the triangles that are ready in one batch.
+			batch := []*spec.Triangle{t}
+		fill:
+			for len(batch) < maxBatchSize {
+				select {
+				case t, ok := <-src:
+					if !ok {
+						break fill
+					}
+					batch = append(batch, t)
+				default:
+					break fill
+				}
+			}
+			values := make([]spec.Triangle, len(batch))
+			for i, t := range batch {
+				values[i] = *t
+			}
+			if len(unacked) == 0 {
+				timeout = time.After(maxTriangleGiveTime)
+			}
+			unacked = append(unacked, batch)
+			err = stream.Send(values)
+		case n, ok := <-acks:
+			if !ok {
+				err = <-ackErr
+				break
+			}
+			if unacked, err = ack(unacked, n, direction); err != nil {
+				break
+			}
+			timeout = nil
+			if len(unacked) > 0 {
+				timeout = time.After(maxTriangleGiveTime)
+			}
+		case <-timeout:
+			err = fmt.Errorf("triangles not acknowledged within %v", maxTriangleGiveTime)
+		}
+		if in = src; !open || len(unacked) >= maxUnackedBatches {
+			in = nil
+		}
+	}
+	if err == nil {
+		err = stream.Finish()
+	}
+	close(cancel)
+	// Batches acknowledged before the stream was aborted were taken by the
+	// remote screen, so must not be returned.
+	for n := range acks {
+		if len(unacked) > 0 {
+			unacked, _ = ack(unacked, n, direction)
+		}
+	}
+	if err != nil {
+		for _, batch := range unacked {
+			for _, t := range batch {
+				returnTriangle(t, direction, myScreen)
+			}
+		}
+		log.Printf("%q.GiveAll failed: %v, aborting connection with remote screen", dst, err)
+		errch <- err
+	}
+	// Return the triangles still sent on src, which the owner of src keeps
+	// doing until it learns of the error.
+drain:
+	for {
+		select {
+		case t, ok := <-src:
+			if !ok {
+				break drain
+			}
+			returnTriangle(t, direction, myScreen)
+		case <-stopped:
+			break drain
+		}
+	}
+	log.Printf("Exiting goroutine with connection to %q", dst)
+}
+
+// ack removes the oldest batch in unacked, which the remote screen
+// acknowledged taking n triangles of.
+func ack(unacked [][]*spec.Triangle, n int32, direction spec.Direction) ([][]*spec.Triangle, error) {
+	if len(unacked) == 0 {
+		return unacked, fmt.Errorf("remote screen acknowledged %d triangles that were not sent", n)
+	}
+	if int(n) != len(unacked[0]) {
+		return unacked, fmt.Errorf("remote screen acknowledged %d of %d triangles", n, len(unacked[0]))
+	}
+	for _, t := range unacked[0] {
+		trace(t, "given to the screen on my %v", direction)
+	}
+	return unacked[1:], nil
+}
+
+// opposite returns the position of a screen relative to another that is in
+// direction d of it.
+func opposite(d spec.Direction) spec.Direction {
+	switch d {
+	case spec.DirectionLeft:
+		return spec.DirectionRight
+	case spec.DirectionRight:
+		return spec.DirectionLeft
+	case spec.DirectionAbove:
+		return spec.DirectionBelow
+	}
+	return spec.DirectionAbove
+}
+
+// geometry returns the Geometry of a screen of size e.
+//
+// size.Event measures density in pixels per typographic point, of which there
+// are 72 to the inch.
+func geometry(e size.Event) spec.Geometry {
+	return spec.Geometry{
+		WidthPx:       int32(e.WidthPx),
+		HeightPx:      int32(e.HeightPx),
+		PixelsPerInch: e.PixelsPerPt * 72,
+	}
+}
+
+// parseDirections parses a comma-separated list of directions.
+func parseDirections(list string) ([]spec.Direction, error) {
+	var ret []spec.Direction
+	for _, label := range strings.Split(list, ",") {
+		if label = strings.TrimSpace(label); len(label) == 0 {
+			continue
+		}
+		d, err := spec.DirectionFromString(label)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// closeNetwork calls nc.Close and discards everything written to the
+// channels of nc, and to myScreen, until that takes effect.
+func closeNetwork(nc NetworkChannels, myScreen <-chan *spec.Triangle) {
+	nc.Close()
+	for nc.Neighbours != nil {
+		select {
+		case _, ok := <-nc.Neighbours:
+			if !ok {
+				nc.Neighbours = nil
+			}
+		case <-nc.Ready:
+		case <-nc.Invitations:
+		case <-myScreen:
 		}
-		cancel()
 	}
-	for t := range src {
-		returnTriangle(t, myScreen)
+}
+
+var errScreenClosed = fmt.Errorf("screen closed")
+
+// deadline returns a channel that is closed after d, or when stop is called
+// if that is sooner.
+func deadline(d time.Duration) (cancel <-chan struct{}, stop func()) {
+	var (
+		ch        = make(chan struct{})
+		once      sync.Once
+		closeOnce = func() { once.Do(func() { close(ch) }) }
+		timer     = time.AfterFunc(d, closeOnce)
+	)
+	return ch, func() {
+		timer.Stop()
+		closeOnce()
 	}
-	ctx.VI(1).Infof("Exiting goroutine with connection to %q", dst)
 }
 
-func selectColor(key security.PublicKey) Color {
+// selectColor returns the Color identifying a screen with the provided
+// unique identifier.
+func selectColor(id []byte) Color {
 	var (
-		bytes, _ = key.MarshalBinary()
-		uid      = md5.Sum(bytes)
-		pick     = func(idx int) float32 {
+		uid  = md5.Sum(id)
+		pick = func(idx int) float32 {
 			//  Keep component between [30, 225] instead of [0,255]
 			// to avoid white and black - and then normalize to [0, 1]
 			return (30 + (float32(uid[idx])/255.0)*(225-30)) / 255
@@ -346,7 +1340,60 @@ func selectColor(key security.PublicKey) Color {
 	return Color{R: pick(0), G: pick(7), B: pick(15)}
 }
 
+// fingerprint returns a digest of id (see Peer.Id), which screens advertise
+// so that the screens inviting them can display their pairing code before
+// they respond.
+func fingerprint(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pairingCode returns the code displayed by the screens with fingerprints a
+// and b while one invites the other, whichever one does, for the user to
+// confirm that the invitation is between them.
+func pairingCode(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	sum := sha256.Sum256([]byte(a + "," + b))
+	return fmt.Sprintf("%0*d", pairingCodeDigits, binary.BigEndian.Uint32(sum[:])%pairingCodeModulus)
+}
+
+// formatColor returns c in the hexadecimal notation of HTML, which is how it
+// is advertised to other screens.
+func formatColor(c Color) string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(c.R*255), uint8(c.G*255), uint8(c.B*255))
+}
+
+// parseColor is the inverse of formatColor, returning gray for a malformed s.
+func parseColor(s string) Color {
+	var r, g, b uint8
+	if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return Color{0.5, 0.5, 0.5}
+	}
+	return Color{float32(r) / 255, float32(g) / 255, float32(b) / 255}
+}
+
 const (
+	versionAttribute      = "Version"
+	roomAttribute         = "Room"
+	osAttribute           = "OS"
+	colorAttribute        = "Color"
+	keyAttribute          = "Key"
+	headAttribute         = "Head" // Identifies the row of screens while the screen is the leftmost in it
 	maxInvitationWaitTime = 30 * time.Second
 	maxTriangleGiveTime   = time.Second / 2
+	inviteRetryInterval   = time.Second
+	maxAlignTime          = time.Second
+	maxJoinRowTime        = time.Second
+	// Bounds on the triangles sent on a GiveAll stream: per batch and in
+	// batches that the remote screen has not acknowledged yet.
+	maxBatchSize      = 64
+	maxUnackedBatches = 4
+	// Number of triangles taken from other screens that are remembered to
+	// drop duplicates.
+	maxRecentTriangles = 1024
+	// Pairing codes are decimal numbers of this many digits.
+	pairingCodeDigits  = 4
+	pairingCodeModulus = 10000
 )
@@ -0,0 +1,859 @@
+package main
+
+import (
+	"fmt"
+	"github.com/asimshankar/triangles/sim"
+	"github.com/asimshankar/triangles/spec"
+	"golang.org/x/mobile/event/size"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cutPoint is a point in the handoff of a batch of triangles over a GiveAll
+// stream at which cutLink breaks the link between two screens.
+type cutPoint int
+
+const (
+	cutNever       cutPoint = iota
+	cutBeforeBatch          // Before the batch is sent
+	cutBeforeTake           // After the batch is sent, before the remote screen takes it
+	cutBeforeAck            // After the remote screen took the batch, before it is acknowledged
+	cutAfterAck             // After the batch is acknowledged
+)
+
+func (p cutPoint) String() string {
+	return [...]string{"never", "before batch", "before take", "before ack", "after ack"}[p]
+}
+
+// cutLink breaks the link between a screen giving triangles over a memTransport
+// and a handler taking them, at a cutPoint in the handoff of the batch-th
+// batch. Once the link is broken, the GiveAll stream fails and the handler
+// refuses triangles.
+type cutLink struct {
+	point cutPoint
+	batch int
+
+	mu                 sync.Mutex
+	sent, given, acked int            // Batches sent, given to the handler and acknowledged so far
+	taken              map[string]int // Number of times every triangle was taken, by Id
+	unacked            [][]string     // Ids of the triangles in the batches taken but not yet acknowledged
+	once               sync.Once
+	cut                chan struct{} // Closed when the link breaks
+	progress           chan<- bool   // Signalled whenever a triangle is taken
+}
+
+func newCutLink(point cutPoint, batch int, progress chan<- bool) *cutLink {
+	return &cutLink{
+		point:    point,
+		batch:    batch,
+		taken:    make(map[string]int),
+		cut:      make(chan struct{}),
+		progress: progress,
+	}
+}
+
+func (l *cutLink) breakLink() { l.once.Do(func() { close(l.cut) }) }
+
+func (l *cutLink) broken() bool {
+	select {
+	case <-l.cut:
+		return true
+	default:
+		return false
+	}
+}
+
+// The ScreenHandler taking the triangles.
+
+func (l *cutLink) Invite(Peer, spec.Direction, spec.Geometry, string, <-chan struct{}) (spec.Geometry, error) {
+	return spec.Geometry{}, fmt.Errorf("not inviting")
+}
+
+func (l *cutLink) Give(caller Peer, triangles []spec.Triangle) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.point == cutBeforeTake && l.given == l.batch {
+		l.breakLink()
+	}
+	if l.broken() {
+		return fmt.Errorf("link broken")
+	}
+	var ids []string
+	for _, t := range triangles {
+		l.taken[t.Id]++
+		ids = append(ids, t.Id)
+		l.progress <- true
+	}
+	l.unacked = append(l.unacked, ids)
+	if l.point == cutBeforeAck && l.given == l.batch {
+		l.breakLink()
+	}
+	l.given++
+	return nil
+}
+
+func (l *cutLink) Align(Peer, spec.Direction, float32, spec.Geometry) error { return nil }
+func (l *cutLink) JoinRow(Peer, string) error                               { return nil }
+
+// cutTransport is the Transport of the screen giving the triangles.
+type cutTransport struct {
+	Transport
+	link *cutLink
+}
+
+func (t cutTransport) GiveAll(addr string, cancel <-chan struct{}) (GiveStream, error) {
+	// Abort the memTransport stream when the link breaks too.
+	inner := make(chan struct{})
+	go func() {
+		select {
+		case <-cancel:
+		case <-t.link.cut:
+		}
+		close(inner)
+	}()
+	stream, err := t.Transport.GiveAll(addr, inner)
+	if err != nil {
+		return nil, err
+	}
+	return cutStream{stream, t.link}, nil
+}
+
+type cutStream struct {
+	GiveStream
+	link *cutLink
+}
+
+func (s cutStream) Send(triangles []spec.Triangle) error {
+	l := s.link
+	l.mu.Lock()
+	if l.point == cutBeforeBatch && l.sent == l.batch {
+		l.breakLink()
+	}
+	if l.broken() {
+		l.mu.Unlock()
+		return fmt.Errorf("link broken")
+	}
+	l.sent++
+	l.mu.Unlock()
+	return s.GiveStream.Send(triangles)
+}
+
+func (s cutStream) Recv() (int32, error) {
+	n, err := s.GiveStream.Recv()
+	l := s.link
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil && l.broken() {
+		// The acknowledgement was lost along with the link.
+		err = fmt.Errorf("link broken")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if l.point == cutAfterAck && l.acked == l.batch {
+		l.breakLink()
+	}
+	l.unacked = l.unacked[1:]
+	l.acked++
+	return n, nil
+}
+
+// TestGiveAllCut checks that channel2rpc hands off or returns every triangle,
+// and only does both for a batch whose acknowledgement was lost, however the
+// link breaks along the way.
+func TestGiveAllCut(t *testing.T) {
+	const (
+		triangles = 6
+		batches   = 4
+	)
+	type test struct {
+		point cutPoint
+		batch int
+	}
+	tests := []test{{cutNever, 0}}
+	for _, p := range []cutPoint{cutBeforeBatch, cutBeforeTake, cutBeforeAck, cutAfterAck} {
+		for b := 0; b < batches; b++ {
+			tests = append(tests, test{p, b})
+		}
+	}
+	for _, test := range tests {
+		var (
+			name     = fmt.Sprintf("%v %d", test.point, test.batch)
+			progress = make(chan bool, triangles*2) // Signalled whenever a triangle is taken or returned
+			link     = newCutLink(test.point, test.batch, progress)
+			network  = newMemNetwork()
+			receiver = network.NewTransport()
+			sender   = cutTransport{network.NewTransport(), link}
+			src      = make(chan *spec.Triangle)
+			errch    = make(chan error, 1)
+			myScreen = make(chan *spec.Triangle)
+			done     = make(chan struct{})
+			returned = make(map[string]int)
+			recvDone = make(chan struct{})
+		)
+		me, err := receiver.Start(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer close(recvDone)
+			for t := range myScreen {
+				returned[t.Id]++
+				progress <- true
+			}
+		}()
+		go func() {
+			channel2rpc(sender, src, nil, me.Id, spec.DirectionRight, errch, myScreen)
+			close(done)
+		}()
+		other := newOtherScreen(spec.DirectionRight, src, myScreen)
+		// Give the triangles one at a time, each in its own batch
+		// unless the link breaks, without waiting for the previous
+		// batch to be acknowledged.
+		for i := 0; i < triangles; i++ {
+			other.send([]*spec.Triangle{{Id: fmt.Sprint(i), X: 1.1, Dx: 0.1}})
+			select {
+			case <-progress:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%v: triangle %d neither taken nor returned", name, i)
+			}
+		}
+		close(src)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: channel2rpc did not return", name)
+		}
+		close(myScreen)
+		<-recvDone
+		receiver.Stop()
+
+		// The batches that were taken but whose acknowledgement never
+		// arrived.
+		lostAck := make(map[string]bool)
+		for _, ids := range link.unacked {
+			for _, id := range ids {
+				lostAck[id] = true
+			}
+		}
+		for i := 0; i < triangles; i++ {
+			id := fmt.Sprint(i)
+			taken, ret := link.taken[id], returned[id]
+			switch {
+			case taken > 1 || ret > 1:
+				t.Errorf("%v: triangle %v taken %d times and returned %d times", name, id, taken, ret)
+			case taken+ret == 0:
+				t.Errorf("%v: triangle %v lost", name, id)
+			case taken+ret == 2 && !lostAck[id]:
+				// Only a batch whose acknowledgement is lost may end
+				// up on both screens.
+				t.Errorf("%v: triangle %v both taken and returned", name, id)
+			}
+		}
+		select {
+		case err := <-errch:
+			if test.point == cutNever {
+				t.Errorf("%v: unexpected error %v", name, err)
+			}
+		default:
+			if test.point != cutNever && link.broken() {
+				t.Errorf("%v: link broken without an error", name)
+			}
+		}
+	}
+}
+
+// TestGiveAllError checks that once the stream fails, channel2rpc returns the
+// triangles still sent to it until their sender stops.
+func TestGiveAllError(t *testing.T) {
+	var (
+		network  = newMemNetwork()
+		src      = make(chan *spec.Triangle)
+		stopped  = make(chan struct{})
+		errch    = make(chan error, 1)
+		myScreen = make(chan *spec.Triangle, 10)
+		done     = make(chan struct{})
+		sent     = make(chan struct{})
+	)
+	go func() {
+		// There is no screen to give the triangles to.
+		channel2rpc(network.NewTransport(), src, stopped, "mem/none", spec.DirectionRight, errch, myScreen)
+		close(done)
+	}()
+	if err := receiveError(t, errch); err == nil {
+		t.Fatal("GiveAll succeeded without a screen to give to")
+	}
+	go func() {
+		newOtherScreen(spec.DirectionRight, src, myScreen).send([]*spec.Triangle{{Id: "0", X: 1.1}, {Id: "1", X: 1.1}})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sending triangles blocked after the stream failed")
+	}
+	if got, want := len(myScreen), 2; got != want {
+		t.Errorf("%d triangles returned, want %d", got, want)
+	}
+	close(stopped)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel2rpc did not return once stopped")
+	}
+}
+
+// giveCounter is a ScreenHandler that counts the triangles given to it.
+type giveCounter struct {
+	taken sync.WaitGroup
+}
+
+func (h *giveCounter) Invite(Peer, spec.Direction, spec.Geometry, string, <-chan struct{}) (spec.Geometry, error) {
+	return spec.Geometry{}, fmt.Errorf("not inviting")
+}
+
+func (h *giveCounter) Give(caller Peer, triangles []spec.Triangle) error {
+	for range triangles {
+		h.taken.Done()
+	}
+	return nil
+}
+
+func (h *giveCounter) Align(Peer, spec.Direction, float32, spec.Geometry) error { return nil }
+func (h *giveCounter) JoinRow(Peer, string) error                               { return nil }
+
+// loopback returns a Transport of kind "mem" or "tcp" to give triangles to h
+// with, at addr.
+func loopback(b *testing.B, kind string, h ScreenHandler) (sender Transport, addr string, stop func()) {
+	switch kind {
+	case "mem":
+		network := newMemNetwork()
+		receiver := network.NewTransport()
+		me, err := receiver.Start(h)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return network.NewTransport(), me.Id, receiver.Stop
+	case "tcp":
+		var transports [2]*tcpTransport
+		for i := range transports {
+			var err error
+			if transports[i], err = newTCPTransport("127.0.0.1:0", *flagTCPGroup); err != nil {
+				b.Fatal(err)
+			}
+		}
+		sender, receiver := transports[0], transports[1]
+		if _, err := receiver.Start(h); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := sender.Start(h); err != nil {
+			b.Fatal(err)
+		}
+		return sender, receiver.listener.Addr().String(), func() {
+			sender.Stop()
+			receiver.Stop()
+		}
+	}
+	b.Fatalf("unknown transport %q", kind)
+	return nil, "", nil
+}
+
+func BenchmarkGiveAllMem(b *testing.B)  { benchmarkGiveAll(b, "mem") }
+func BenchmarkGiveEachMem(b *testing.B) { benchmarkGiveEach(b, "mem") }
+func BenchmarkGiveAllTCP(b *testing.B)  { benchmarkGiveAll(b, "tcp") }
+func BenchmarkGiveEachTCP(b *testing.B) { benchmarkGiveEach(b, "tcp") }
+
+// benchmarkGiveAll measures giving triangles to another screen through
+// channel2rpc, which batches them over a single GiveAll stream.
+func benchmarkGiveAll(b *testing.B, kind string) {
+	h := new(giveCounter)
+	sender, addr, stop := loopback(b, kind, h)
+	defer stop()
+	var (
+		src      = make(chan *spec.Triangle)
+		errch    = make(chan error, 1)
+		myScreen = make(chan *spec.Triangle, 1)
+		done     = make(chan struct{})
+	)
+	go func() {
+		channel2rpc(sender, src, nil, addr, spec.DirectionRight, errch, myScreen)
+		close(done)
+	}()
+	b.ResetTimer()
+	h.taken.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		src <- &spec.Triangle{X: 1.1, Dx: 0.1}
+	}
+	h.taken.Wait()
+	b.StopTimer()
+	close(src)
+	<-done
+	select {
+	case err := <-errch:
+		b.Fatal(err)
+	default:
+	}
+}
+
+// benchmarkGiveEach measures giving triangles to another screen one at a
+// time with Give, waiting for the other screen to take each one before giving
+// the next.
+func benchmarkGiveEach(b *testing.B, kind string) {
+	h := new(giveCounter)
+	sender, addr, stop := loopback(b, kind, h)
+	defer stop()
+	b.ResetTimer()
+	h.taken.Add(b.N)
+	for i := 0; i < b.N; i++ {
+		if err := sender.Give(addr, spec.Triangle{X: 1.1, Dx: 0.1}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	h.taken.Wait()
+}
+
+// testScreen runs a networkManager over a Transport and buffers what it
+// notifies the user interface of, for tests to wait for.
+type testScreen struct {
+	net         NetworkChannels
+	addr        string // Of the screen on its Transport
+	color       Color
+	invitations chan Invitation
+	pairings    chan Pairing
+	candidates  chan Candidate
+	neighbours  chan Neighbour
+	triangles   chan *spec.Triangle
+	chMyScreen  chan *spec.Triangle
+	done        chan struct{}
+}
+
+func newTestScreen(t *testing.T, transport Transport, invite string) *testScreen {
+	s := &testScreen{
+		invitations: make(chan Invitation, 10),
+		pairings:    make(chan Pairing, 10),
+		candidates:  make(chan Candidate, 100),
+		neighbours:  make(chan Neighbour, 10),
+		triangles:   make(chan *spec.Triangle, 1000),
+		chMyScreen:  make(chan *spec.Triangle),
+		done:        make(chan struct{}),
+	}
+	s.net = setupNetwork(transport, invite, "", s.chMyScreen)
+	s.net.Resize(size.Event{WidthPx: simulatedWidthPx, HeightPx: simulatedHeightPx, PixelsPerPt: 1})
+	select {
+	case ready := <-s.net.Ready:
+		if err, ok := ready.(error); ok {
+			t.Fatal(err)
+		}
+		s.color = ready.(Color)
+	case <-time.After(maxSimulatedLinkTime):
+		t.Fatalf("screen not ready after %v", maxSimulatedLinkTime)
+	}
+	if mt, ok := transport.(*memTransport); ok {
+		s.addr = mt.name
+	}
+	go s.loop()
+	return s
+}
+
+func (s *testScreen) loop() {
+	defer close(s.done)
+	for {
+		select {
+		case inv := <-s.net.Invitations:
+			s.invitations <- inv
+		case p := <-s.net.Pairings:
+			s.pairings <- p
+		case c := <-s.net.Candidates:
+			s.candidates <- c
+		case n, ok := <-s.net.Neighbours:
+			if !ok {
+				return
+			}
+			s.neighbours <- n
+		case t := <-s.chMyScreen:
+			s.triangles <- t
+		}
+	}
+}
+
+func (s *testScreen) close() {
+	s.net.Close()
+	<-s.done
+}
+
+func (s *testScreen) nextInvitation(t *testing.T) Invitation {
+	select {
+	case inv := <-s.invitations:
+		return inv
+	case <-time.After(maxSimulatedLinkTime):
+		t.Fatalf("no invitation after %v", maxSimulatedLinkTime)
+	}
+	return Invitation{}
+}
+
+func (s *testScreen) nextNeighbour(t *testing.T) Neighbour {
+	select {
+	case n := <-s.neighbours:
+		return n
+	case <-time.After(maxSimulatedLinkTime):
+		t.Fatalf("no neighbour after %v", maxSimulatedLinkTime)
+	}
+	return Neighbour{}
+}
+
+// receiveError waits for an error from ch.
+func receiveError(t *testing.T, ch <-chan error) error {
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(maxSimulatedLinkTime):
+		t.Fatalf("no response after %v", maxSimulatedLinkTime)
+	}
+	return nil
+}
+
+func TestInvitationWithdrawn(t *testing.T) {
+	var (
+		network = newMemNetwork()
+		screen  = newTestScreen(t, network.NewTransport(), "")
+		inviter = network.NewTransport()
+		errs    = make(chan error, 1)
+		invite  = func(cancel <-chan struct{}) {
+			_, _, err := inviter.Invite(screen.addr, spec.DirectionRight, spec.Geometry{}, "inviter", cancel)
+			errs <- err
+		}
+	)
+	defer screen.close()
+	if _, err := inviter.Start(new(giveCounter)); err != nil {
+		t.Fatal(err)
+	}
+	defer inviter.Stop()
+
+	cancel := make(chan struct{})
+	go invite(cancel)
+	screen.nextInvitation(t)
+	close(cancel)
+	if err := receiveError(t, errs); err == nil {
+		t.Fatal("Withdrawn invitation accepted")
+	}
+	// Without a response from the user interface, the screen must still
+	// consider the next invitation.
+	go invite(nil)
+	inv := screen.nextInvitation(t)
+	inv.Response <- nil
+	if err := receiveError(t, errs); err != nil {
+		t.Fatalf("Invitation refused: %v", err)
+	}
+	if n := screen.nextNeighbour(t); n.Direction != spec.DirectionLeft || n.Triangles == nil {
+		t.Errorf("Got neighbour %v (active: %v), want an active one on the left", n.Direction, n.Triangles != nil)
+	}
+}
+
+// giveOne gives tri to the screen at addr over a GiveAll stream from
+// transport, and returns the error with which the batch is refused.
+func giveOne(transport Transport, addr string, tri spec.Triangle) error {
+	stream, err := transport.GiveAll(addr, nil)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send([]spec.Triangle{tri}); err != nil {
+		return err
+	}
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+	return stream.Finish()
+}
+
+func TestGiveUnlinked(t *testing.T) {
+	var (
+		network  = newMemNetwork()
+		screen   = newTestScreen(t, network.NewTransport(), "")
+		linked   = network.NewTransport()
+		stranger = network.NewTransport()
+		errs     = make(chan error, 1)
+		tri      = spec.Triangle{Id: "given", X: 1.1, Y: 0.5, Dx: 0.1, Size: sim.DefaultSize}
+	)
+	defer screen.close()
+	for _, transport := range []Transport{linked, stranger} {
+		if _, err := transport.Start(new(giveCounter)); err != nil {
+			t.Fatal(err)
+		}
+		defer transport.Stop()
+	}
+	go func() {
+		_, _, err := linked.Invite(screen.addr, spec.DirectionRight, spec.Geometry{}, "linked", nil)
+		errs <- err
+	}()
+	screen.nextInvitation(t).Response <- nil
+	if err := receiveError(t, errs); err != nil {
+		t.Fatalf("Invitation refused: %v", err)
+	}
+	screen.nextNeighbour(t)
+
+	if err := giveOne(stranger, screen.addr, tri); err == nil {
+		t.Errorf("Triangles from a screen that is not linked were accepted")
+	}
+	if err := giveOne(linked, screen.addr, tri); err != nil {
+		t.Fatalf("Triangles from the linked screen were refused: %v", err)
+	}
+	select {
+	case got := <-screen.triangles:
+		if got.Id != tri.Id {
+			t.Errorf("Got triangle %q, want %q", got.Id, tri.Id)
+		}
+	case <-time.After(maxSimulatedLinkTime):
+		t.Fatalf("Triangle not taken after %v", maxSimulatedLinkTime)
+	}
+	select {
+	case got := <-screen.triangles:
+		t.Errorf("Got triangle %q from the screen that is not linked", got.Id)
+	default:
+	}
+}
+
+// nextPairing returns the next pairing code that s displays.
+func (s *testScreen) nextPairing(t *testing.T) Pairing {
+	select {
+	case p := <-s.pairings:
+		return p
+	case <-time.After(maxSimulatedLinkTime):
+		t.Fatalf("no pairing after %v", maxSimulatedLinkTime)
+	}
+	return Pairing{}
+}
+
+func TestPairingCode(t *testing.T) {
+	var (
+		network = newMemNetwork()
+		inviter = newTestScreen(t, network.NewTransport(), "right")
+		invitee = newTestScreen(t, network.NewTransport(), "")
+	)
+	defer inviter.close()
+	defer invitee.close()
+	inv := invitee.nextInvitation(t)
+	p := inviter.nextPairing(t)
+	if len(p.Code) == 0 || p.Code != inv.Code || p.Direction != spec.DirectionRight {
+		t.Errorf("The inviter displays code %q on its %v, the invitee %q", p.Code, p.Direction, inv.Code)
+	}
+	inv.Response <- nil
+	if p := inviter.nextPairing(t); len(p.Code) > 0 {
+		t.Errorf("The inviter still displays code %q once the invitee responded", p.Code)
+	}
+}
+
+func TestFingerprintMismatch(t *testing.T) {
+	var (
+		network = newMemNetwork()
+		inviter = newTestScreen(t, network.NewTransport(), "right")
+		forger  = network.NewTransport()
+	)
+	defer inviter.close()
+	// forger accepts every invitation, but advertises another key than
+	// its own.
+	if _, err := forger.Start(new(inviteResponder)); err != nil {
+		t.Fatal(err)
+	}
+	defer forger.Stop()
+	stop, err := forger.Advertise(map[string]string{
+		versionAttribute: specVersion,
+		roomAttribute:    "",
+		colorAttribute:   formatColor(Color{1, 0, 0}),
+		keyAttribute:     fingerprint("someone else"),
+		headAttribute:    "forger",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// The code is displayed until the forger accepts.
+	if p := inviter.nextPairing(t); len(p.Code) == 0 {
+		t.Fatalf("Got pairing %+v, want a code", p)
+	}
+	if p := inviter.nextPairing(t); len(p.Code) > 0 {
+		t.Fatalf("Got pairing %+v, want no code", p)
+	}
+	// Had the inviter linked up with the forger, it would not invite
+	// another screen.
+	invitee := newTestScreen(t, network.NewTransport(), "")
+	defer invitee.close()
+	invitee.nextInvitation(t).Response <- nil
+	if n := inviter.nextNeighbour(t); n.Direction != spec.DirectionRight {
+		t.Errorf("Got neighbour on the %v, want the invitee on the Right", n.Direction)
+	}
+}
+
+func TestPick(t *testing.T) {
+	*flagPick = true
+	defer func() { *flagPick = false }()
+	var (
+		network = newMemNetwork()
+		picker  = newTestScreen(t, network.NewTransport(), "right")
+		others  = []*testScreen{
+			newTestScreen(t, network.NewTransport(), ""),
+			newTestScreen(t, network.NewTransport(), ""),
+		}
+		picked = others[1]
+		ids    = make(map[string]string) // Of the candidates, by formatted color
+	)
+	defer picker.close()
+	for _, s := range others {
+		defer s.close()
+	}
+	for len(ids) < len(others) {
+		select {
+		case c := <-picker.candidates:
+			if c.Direction != spec.DirectionRight || c.Lost {
+				t.Fatalf("Got candidate %+v, want one on the Right", c)
+			}
+			ids[formatColor(c.Color)] = c.Id
+		case <-time.After(maxSimulatedLinkTime):
+			t.Fatalf("%d of %d candidates offered after %v", len(ids), len(others), maxSimulatedLinkTime)
+		}
+	}
+	picker.net.Pick(spec.DirectionRight, ids[formatColor(picked.color)])
+	picked.nextInvitation(t).Response <- nil
+	if n := picker.nextNeighbour(t); n.Direction != spec.DirectionRight {
+		t.Errorf("Got neighbour on the %v, want the picked screen on the Right", n.Direction)
+	}
+	select {
+	case inv := <-others[0].invitations:
+		t.Errorf("Screen that was not picked got invitation %+v", inv)
+	default:
+	}
+}
+
+// geometryRecorder is a ScreenHandler that records the geometries sent to it
+// with Align.
+type geometryRecorder struct {
+	giveCounter
+	geometries chan spec.Geometry
+}
+
+func (h *geometryRecorder) Align(caller Peer, side spec.Direction, marker float32, geometry spec.Geometry) error {
+	h.geometries <- geometry
+	return nil
+}
+
+func TestResizeRealigns(t *testing.T) {
+	var (
+		network  = newMemNetwork()
+		screen   = newTestScreen(t, network.NewTransport(), "")
+		inviter  = network.NewTransport()
+		recorder = &geometryRecorder{geometries: make(chan spec.Geometry, 10)}
+		errs     = make(chan error, 1)
+		resized  = size.Event{WidthPx: 2 * simulatedWidthPx, HeightPx: simulatedHeightPx, PixelsPerPt: 1}
+	)
+	defer screen.close()
+	if _, err := inviter.Start(recorder); err != nil {
+		t.Fatal(err)
+	}
+	defer inviter.Stop()
+	go func() {
+		_, _, err := inviter.Invite(screen.addr, spec.DirectionRight, spec.Geometry{}, "inviter", nil)
+		errs <- err
+	}()
+	screen.nextInvitation(t).Response <- nil
+	if err := receiveError(t, errs); err != nil {
+		t.Fatalf("Invitation refused: %v", err)
+	}
+	screen.nextNeighbour(t)
+
+	screen.net.Resize(resized)
+	select {
+	case got := <-recorder.geometries:
+		if want := geometry(resized); got != want {
+			t.Errorf("Got geometry %+v, want %+v", got, want)
+		}
+	case <-time.After(maxSimulatedLinkTime):
+		t.Fatalf("Geometry not sent after %v", maxSimulatedLinkTime)
+	}
+}
+
+// inviteResponder is a ScreenHandler that responds to invitations with err,
+// or accepts them if err is nil.
+type inviteResponder struct {
+	giveCounter
+	err error
+}
+
+func (h *inviteResponder) Invite(Peer, spec.Direction, spec.Geometry, string, <-chan struct{}) (spec.Geometry, error) {
+	return spec.Geometry{WidthPx: 1}, h.err
+}
+
+func TestSendOneInvite(t *testing.T) {
+	network := newMemNetwork()
+	start := func(err error) string {
+		me, startErr := network.NewTransport().Start(&inviteResponder{err: err})
+		if startErr != nil {
+			t.Fatal(startErr)
+		}
+		return me.Id
+	}
+	var (
+		accepting = start(nil)
+		busy      = start(errBusy)
+		stale     = start(errStaleRow)
+		wrapped   = start(fmt.Errorf("remote error: %v", errBusy))
+		refusing  = start(fmt.Errorf("not today"))
+		missing   = "mem/none"
+		sender    = network.NewTransport()
+	)
+	tests := []struct {
+		addrs []string
+		err   error // nil if the invitation is accepted
+	}{
+		{[]string{accepting}, nil},
+		{[]string{refusing, accepting, missing}, nil},
+		{[]string{busy}, errBusy},
+		{[]string{wrapped}, errBusy},
+		{[]string{stale}, errStaleRow},
+		{[]string{busy, refusing, missing}, errBusy},
+		{[]string{refusing, missing, busy}, errBusy},
+		{[]string{missing, stale, refusing}, errStaleRow},
+	}
+	for _, test := range tests {
+		peer, geometry, err := sendOneInvite(sender, test.addrs, spec.DirectionRight, spec.Geometry{}, "")
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%v: got error %v", test.addrs, err)
+		case test.err == nil && (peer.Name != accepting || geometry.WidthPx != 1):
+			t.Errorf("%v: got %+v with %+v, want %v", test.addrs, peer, geometry, accepting)
+		case test.err != nil && err != test.err:
+			t.Errorf("%v: got error %v, want %v", test.addrs, err, test.err)
+		}
+	}
+	for _, addrs := range [][]string{{refusing}, {missing}, nil} {
+		if _, _, err := sendOneInvite(sender, addrs, spec.DirectionRight, spec.Geometry{}, ""); err == nil || err == errBusy || err == errStaleRow {
+			t.Errorf("%v: got error %v, want another one", addrs, err)
+		}
+	}
+}
+
+// TestSendOneInviteDrains checks that sendOneInvite leaves no goroutine behind
+// once an invitation is accepted, however many other addresses it sent it to.
+func TestSendOneInviteDrains(t *testing.T) {
+	network := newMemNetwork()
+	var addrs []string
+	for _, err := range []error{nil, errBusy, errBusy, errBusy} {
+		me, startErr := network.NewTransport().Start(&inviteResponder{err: err})
+		if startErr != nil {
+			t.Fatal(startErr)
+		}
+		addrs = append(addrs, me.Id)
+	}
+	sender := network.NewTransport()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if _, _, err := sendOneInvite(sender, addrs, spec.DirectionRight, spec.Geometry{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left behind", runtime.NumGoroutine()-before)
+		}
+	}
+}
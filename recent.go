@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"sync"
+)
+
+// recentTriangles remembers the Id and Hops of the most recent triangles
+// taken from other screens, so that ones given more than once can be
+// dropped.
+type recentTriangles struct {
+	mu    sync.Mutex
+	seen  map[recentTriangle]bool
+	order []recentTriangle // Entries of seen, oldest replaced first
+	next  int              // Index in order of the oldest entry
+}
+
+type recentTriangle struct {
+	id   string
+	hops int32
+}
+
+func newRecentTriangles(size int) *recentTriangles {
+	return &recentTriangles{
+		seen:  make(map[recentTriangle]bool),
+		order: make([]recentTriangle, 0, size),
+	}
+}
+
+// add records t and returns false if it had already been recorded.
+// Triangles without an Id (e.g., manufactured by a client) are never
+// considered duplicates.
+func (r *recentTriangles) add(t *spec.Triangle) bool {
+	if len(t.Id) == 0 {
+		return true
+	}
+	key := recentTriangle{t.Id, t.Hops}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[key] {
+		return false
+	}
+	r.seen[key] = true
+	if len(r.order) < cap(r.order) {
+		r.order = append(r.order, key)
+		return true
+	}
+	delete(r.seen, r.order[r.next])
+	r.order[r.next] = key
+	r.next = (r.next + 1) % len(r.order)
+	return true
+}
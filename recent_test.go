@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"testing"
+)
+
+func TestRecentTriangles(t *testing.T) {
+	r := newRecentTriangles(2)
+	steps := []struct {
+		id   string
+		hops int32
+		want bool // Expected result of add
+	}{
+		{"a", 0, true},
+		{"a", 0, false}, // Given twice for the same hop
+		{"a", 1, true},  // Came back after another hop
+		{"", 0, true},   // Without an Id
+		{"", 0, true},
+		{"b", 0, true}, // Evicts {a, 0}
+		{"a", 1, false},
+		{"a", 0, true}, // Evicts {a, 1}
+		{"b", 0, false},
+		{"c", 0, true}, // Evicts {b, 0}
+		{"b", 0, true},
+	}
+	for i, s := range steps {
+		if got := r.add(&spec.Triangle{Id: s.id, Hops: s.hops}); got != s.want {
+			t.Errorf("Step #%d: add(%q, %d) = %v, want %v", i, s.id, s.hops, got, s.want)
+		}
+	}
+	if got, want := len(r.seen), 2; got != want {
+		t.Errorf("%d triangles remembered, want %d", got, want)
+	}
+}
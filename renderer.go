@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"golang.org/x/mobile/gl"
+	"log"
+	"time"
+)
+
+// Renderer paints Scenes.
+//
+// Init is invoked when the app becomes visible, with the GL context (if any)
+// of the app's window, and Release when it is no longer visible. Paint is
+// invoked for every frame between the two.
+type Renderer interface {
+	Init(ctx gl.Context) error
+	Paint(scn Scene)
+	Release()
+}
+
+var (
+	flagRenderer = flag.String("renderer", "gl", "Renderer used to paint the screen: one of gl, headless, recording or none")
+	flagFPS      = flag.Bool("fps", true, "Whether to paint the frame rate on the screen (only with --renderer=gl)")
+	flagSnapshot = flag.String("snapshot", "triangles.png", "PNG file that the headless renderer periodically writes the screen to")
+)
+
+// newRenderer returns the Renderer selected by command-line flags.
+func newRenderer() (Renderer, error) {
+	switch *flagRenderer {
+	case "gl":
+		if *flagFPS {
+			return multiRenderer{&GL{}, &GLDebug{}}, nil
+		}
+		return &GL{}, nil
+	case "headless":
+		return &snapshotRenderer{Headless: NewHeadless(1, 1), filename: *flagSnapshot}, nil
+	case "recording":
+		return &recordingRenderer{}, nil
+	case "none":
+		return multiRenderer{}, nil
+	}
+	return nil, fmt.Errorf("unknown renderer %q", *flagRenderer)
+}
+
+// multiRenderer paints with each Renderer in sequence, so later ones paint
+// over earlier ones.
+type multiRenderer []Renderer
+
+func (m multiRenderer) Init(ctx gl.Context) error {
+	for i, r := range m {
+		if err := r.Init(ctx); err != nil {
+			for _, r := range m[:i] {
+				r.Release()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiRenderer) Paint(scn Scene) {
+	for _, r := range m {
+		r.Paint(scn)
+	}
+}
+
+func (m multiRenderer) Release() {
+	for _, r := range m {
+		r.Release()
+	}
+}
+
+// snapshotRenderer is a Headless that periodically writes what it painted to
+// a PNG file.
+type snapshotRenderer struct {
+	*Headless
+	filename string
+	last     time.Time // When filename was last written
+}
+
+func (s *snapshotRenderer) Paint(scn Scene) {
+	s.Headless.Paint(scn)
+	if now := time.Now(); now.Sub(s.last) >= snapshotInterval {
+		s.last = now
+		if err := s.SavePNG(s.filename); err != nil {
+			log.Printf("Failed to write snapshot to %q: %v", s.filename, err)
+		}
+	}
+}
+
+const snapshotInterval = time.Second
@@ -0,0 +1,109 @@
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+)
+
+// collide resolves a collision, if any, between t1 and t2.
+//
+// The velocities of colliding triangles are changed by an impulse along the
+// contact normal (scaled by w.Restitution), which also makes them spin if it
+// is not applied through their centers, and their positions are corrected so
+// that they no longer overlap. Triangles that are held are treated as having
+// infinite mass, i.e., they push other triangles but are not pushed
+// themselves.
+//
+// b1 and b2 are the bodies of t1 and t2 (with their inverseMass set), which
+// are moved along with them.
+func (w *World) collide(t1, t2 *spec.Triangle, b1, b2 *body) {
+	n, depth, ok := overlap(b1, b2)
+	if !ok {
+		return
+	}
+	inv1, inv2 := b1.inverseMass, b2.inverseMass
+	if inv1+inv2 == 0 {
+		return
+	}
+	// Approximate the point of contact by the midpoint of the vertices
+	// of each triangle that are deepest inside the other.
+	var (
+		contact    = support(b1.polygon(), n).add(support(b2.polygon(), n.scale(-1))).scale(0.5)
+		r1, r2     = contact.sub(b1.center), contact.sub(b2.center)
+		invI1      = inv1 / inertiaPerMass(t1)
+		invI2      = inv2 / inertiaPerMass(t2)
+		v1         = vec{t1.Dx, t1.Dy}.add(r1.perp().scale(t1.Omega))
+		v2         = vec{t2.Dx, t2.Dy}.add(r2.perp().scale(t2.Omega))
+		rn1, rn2   = r1.cross(n), r2.cross(n)
+		vn         = v2.sub(v1).dot(n)
+		effectiveM = inv1 + inv2 + rn1*rn1*invI1 + rn2*rn2*invI2
+	)
+	// Impulse, only if the triangles are moving towards each other.
+	if vn < 0 {
+		j := -(1 + w.Restitution) * vn / effectiveM
+		impulse := n.scale(j)
+		t1.Dx, t1.Dy = t1.Dx-impulse.x*inv1, t1.Dy-impulse.y*inv1
+		t2.Dx, t2.Dy = t2.Dx+impulse.x*inv2, t2.Dy+impulse.y*inv2
+		t1.Omega -= r1.cross(impulse) * invI1
+		t2.Omega += r2.cross(impulse) * invI2
+	}
+	// Positional correction, so that overlapping triangles do not stick
+	// to each other.
+	if depth > penetrationSlop {
+		corr := n.scale((depth - penetrationSlop) * penetrationCorrection / (inv1 + inv2))
+		t1.X, t1.Y = t1.X-corr.x*inv1, t1.Y-corr.y*inv1
+		t2.X, t2.Y = t2.X+corr.x*inv2, t2.Y+corr.y*inv2
+		b1.move(corr.scale(-inv1))
+		b2.move(corr.scale(inv2))
+	}
+}
+
+func (w *World) inverseMass(t *spec.Triangle) float32 {
+	if _, held := w.held[t]; held {
+		return 0
+	}
+	mass := DefaultMass
+	if w.Mass != nil {
+		mass = w.Mass
+	}
+	if m := mass(t); m > 0 {
+		return 1 / m
+	}
+	return 0
+}
+
+// DefaultMass is the mass of triangles in a World without a Mass function:
+// proportional to their area, with a triangle of DefaultSize having a mass
+// of 1.
+func DefaultMass(t *spec.Triangle) float32 {
+	return area(t) / area(&spec.Triangle{Size: DefaultSize})
+}
+
+// Spin returns the angular velocity acquired by t when it is pushed with
+// velocity (dx, dy) at offset (rx, ry) from its center, as happens when it
+// is flicked by a touch that did not grab it at the center.
+func Spin(t *spec.Triangle, rx, ry, dx, dy float32) float32 {
+	r := vec{rx, ry}
+	omega := r.cross(vec{dx, dy}) / (r.dot(r) + inertiaPerMass(t))
+	switch {
+	case omega > MaxSpin:
+		return MaxSpin
+	case omega < -MaxSpin:
+		return -MaxSpin
+	}
+	return omega
+}
+
+const (
+	// DefaultRestitution is the restitution of collisions in a World
+	// returned by NewWorld.
+	DefaultRestitution = 0.9
+	// MaxSpin is the maximum angular velocity (in radians per second)
+	// imparted by Spin.
+	MaxSpin = 4 * math.Pi
+	// Overlap tolerated between triangles before their positions are
+	// corrected, and the fraction of the remaining overlap that is
+	// corrected in a single step.
+	penetrationSlop       = 0.001
+	penetrationCorrection = 0.8
+)
@@ -0,0 +1,146 @@
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+	"testing"
+)
+
+func TestCollide(t *testing.T) {
+	const size = 0.1
+	tests := []struct {
+		name   string
+		t1, t2 spec.Triangle
+	}{
+		{
+			name: "head-on",
+			t1:   spec.Triangle{X: -0.045, Dx: 1, Size: size, Shape: spec.ShapeSquare},
+			t2:   spec.Triangle{X: 0.045, Dx: -1, Size: size, Shape: spec.ShapeSquare},
+		},
+		{
+			name: "head-on triangles",
+			t1:   spec.Triangle{X: -0.045, Dx: 1, Size: size},
+			t2:   spec.Triangle{X: 0.045, Dx: -1, Size: size},
+		},
+		{
+			name: "mirrored",
+			t1:   spec.Triangle{X: -0.045, Dx: 1, Angle: 0.3, Size: size},
+			t2:   spec.Triangle{X: 0.045, Dx: -1, Angle: -0.3, Size: size},
+		},
+		{
+			name: "glancing",
+			t1:   spec.Triangle{X: -0.045, Y: -0.045, Dx: 1, Size: size, Shape: spec.ShapeSquare},
+			t2:   spec.Triangle{X: 0.045, Y: 0.045, Dy: -0.2, Size: size, Shape: spec.ShapeSquare},
+		},
+		{
+			name: "corner to corner",
+			t1:   spec.Triangle{X: -0.045, Y: -0.045, Dx: 1, Dy: 1, Size: size, Shape: spec.ShapeSquare},
+			t2:   spec.Triangle{X: 0.045, Y: 0.045, Size: size, Shape: spec.ShapeSquare},
+		},
+		{
+			name: "resting",
+			t1:   spec.Triangle{X: -0.045, Size: size, Shape: spec.ShapeSquare},
+			t2:   spec.Triangle{X: 0.045, Size: size, Shape: spec.ShapeSquare},
+		},
+		{
+			name: "separating",
+			t1:   spec.Triangle{X: -0.045, Dx: -1, Size: size, Shape: spec.ShapeSquare},
+			t2:   spec.Triangle{X: 0.045, Dx: 1, Size: size, Shape: spec.ShapeSquare},
+		},
+	}
+	w := NewWorld()
+	for _, test := range tests {
+		t1, t2 := test.t1, test.t2
+		b1, b2 := newTestBody(w, &t1), newTestBody(w, &t2)
+		n, depth, ok := overlap(b1, b2)
+		if !ok {
+			t.Errorf("%v: the triangles do not overlap", test.name)
+			continue
+		}
+		var (
+			contact      = support(b1.polygon(), n).add(support(b2.polygon(), n.scale(-1))).scale(0.5)
+			r1, r2       = contact.sub(b1.center), contact.sub(b2.center)
+			vnBefore     = normalVelocity(&t1, &t2, r1, r2, n)
+			pBefore      = momentum(w, &t1, &t2)
+			wantVnAfter  = -w.Restitution * vnBefore
+			unchangedVel = vnBefore >= 0
+		)
+		w.collide(&t1, &t2, b1, b2)
+
+		if p := momentum(w, &t1, &t2); p.sub(pBefore).length() > 1e-5 {
+			t.Errorf("%v: momentum went from %v to %v", test.name, pBefore, p)
+		}
+		vnAfter := normalVelocity(&t1, &t2, r1, r2, n)
+		switch {
+		case unchangedVel && (t1.Dx != test.t1.Dx || t1.Dy != test.t1.Dy || t2.Dx != test.t2.Dx || t2.Dy != test.t2.Dy):
+			t.Errorf("%v: triangles not moving towards each other changed velocity: %+v, %+v", test.name, t1, t2)
+		case !unchangedVel && math.Abs(float64(vnAfter-wantVnAfter)) > 1e-4:
+			t.Errorf("%v: relative normal velocity went from %v to %v, want %v", test.name, vnBefore, vnAfter, wantVnAfter)
+		}
+		if _, after, ok := overlap(b1, b2); ok && after >= depth {
+			t.Errorf("%v: overlap went from %v to %v", test.name, depth, after)
+		}
+
+		// Swapping the triangles must not change the outcome.
+		s1, s2 := test.t1, test.t2
+		w.collide(&s2, &s1, newTestBody(w, &s2), newTestBody(w, &s1))
+		if !closeTriangles(s1, t1) || !closeTriangles(s2, t2) || math.Abs(float64(s1.Omega-t1.Omega)) > 1e-5 || math.Abs(float64(s2.Omega-t2.Omega)) > 1e-5 {
+			t.Errorf("%v: got %+v and %+v, but %+v and %+v with the triangles swapped", test.name, t1, t2, s1, s2)
+		}
+	}
+}
+
+// TestOverlapSymmetric checks that the normal returned by overlap is negated
+// when the polygons are swapped, even for identical ones that overlap as much
+// along an edge of one as along an edge of the other.
+func TestOverlapSymmetric(t *testing.T) {
+	w := NewWorld()
+	for _, shape := range []spec.Shape{spec.ShapeTriangle, spec.ShapeSquare, spec.ShapeHexagon} {
+		for _, angle := range []float32{0, 0.3, 1} {
+			for _, offset := range []vec{{0.05, 0}, {0, 0.05}, {0.05, 0.05}, {-0.05, 0.05}, {0.04, -0.04}, {-0.03, 0.05}} {
+				// The second polygon is the mirror image of the
+				// first across the bisector of their centers.
+				var (
+					mirror = 2 * float32(math.Atan2(float64(offset.y), float64(offset.x)))
+					t1     = spec.Triangle{Size: 0.1, Shape: shape, Angle: angle}
+					t2     = spec.Triangle{X: offset.x, Y: offset.y, Size: 0.1, Shape: shape, Angle: mirror + math.Pi - angle}
+					b1, b2 = newTestBody(w, &t1), newTestBody(w, &t2)
+				)
+				n12, d12, ok12 := overlap(b1, b2)
+				n21, d21, ok21 := overlap(b2, b1)
+				if ok12 != ok21 {
+					t.Errorf("%v at %v and %v: overlap %v one way and %v the other", shape, angle, offset, ok12, ok21)
+				}
+				if !ok12 || !ok21 {
+					continue
+				}
+				if n12.add(n21).length() > 1e-5 || math.Abs(float64(d12-d21)) > 1e-5 {
+					t.Errorf("%v at %v and %v: got normal %v and depth %v, but %v and %v swapped", shape, angle, offset, n12, d12, n21, d21)
+				}
+			}
+		}
+	}
+}
+
+func newTestBody(w *World, t *spec.Triangle) *body {
+	b := new(body)
+	b.reset(t)
+	b.inverseMass = w.inverseMass(t)
+	return b
+}
+
+// normalVelocity returns the velocity of the point of t2 at r2 relative to
+// that of t1 at r1, along n.
+func normalVelocity(t1, t2 *spec.Triangle, r1, r2, n vec) float32 {
+	v1 := vec{t1.Dx, t1.Dy}.add(r1.perp().scale(t1.Omega))
+	v2 := vec{t2.Dx, t2.Dy}.add(r2.perp().scale(t2.Omega))
+	return v2.sub(v1).dot(n)
+}
+
+func momentum(w *World, triangles ...*spec.Triangle) vec {
+	var p vec
+	for _, t := range triangles {
+		p = p.add(vec{t.Dx, t.Dy}.scale(1 / w.inverseMass(t)))
+	}
+	return p
+}
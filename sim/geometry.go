@@ -0,0 +1,296 @@
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+)
+
+// vec is a 2D vector in the coordinate system of the World.
+type vec struct{ x, y float32 }
+
+func (a vec) add(b vec) vec       { return vec{a.x + b.x, a.y + b.y} }
+func (a vec) sub(b vec) vec       { return vec{a.x - b.x, a.y - b.y} }
+func (a vec) scale(s float32) vec { return vec{a.x * s, a.y * s} }
+func (a vec) dot(b vec) float32   { return a.x*b.x + a.y*b.y }
+func (a vec) perp() vec           { return vec{-a.y, a.x} }
+func (a vec) cross(b vec) float32 { return a.x*b.y - a.y*b.x }
+func (a vec) length() float32     { return float32(math.Sqrt(float64(a.dot(a)))) }
+func (a vec) normalize() (vec, bool) {
+	l := a.length()
+	if l == 0 {
+		return vec{}, false
+	}
+	return a.scale(1 / l), true
+}
+
+// Vertices returns the corners of t (in counter-clockwise order) as drawn on
+// the screen, in the coordinate system of the World.
+func Vertices(t *spec.Triangle) [][2]float32 {
+	return points(polygon(t))
+}
+
+// Outline returns the corners (in counter-clockwise order) of an upright
+// shape of the given size centered at the origin. The shape is convex, so
+// the corners can be drawn as a triangle fan.
+func Outline(shape spec.Shape, size float32) [][2]float32 {
+	return points(outline(shape, size))
+}
+
+// Size returns the size of t, accounting for the default.
+func Size(t *spec.Triangle) float32 {
+	if t.Size > 0 {
+		return t.Size
+	}
+	return DefaultSize
+}
+
+func points(poly []vec) [][2]float32 {
+	ret := make([][2]float32, len(poly))
+	for i, v := range poly {
+		ret[i] = [2]float32{v.x, v.y}
+	}
+	return ret
+}
+
+func outline(shape spec.Shape, size float32) []vec {
+	var v [maxVertices]vec
+	n := outlineInto(&v, shape, size)
+	return append([]vec(nil), v[:n]...)
+}
+
+// maxVertices is the number of corners of the shape with the most of them.
+const maxVertices = 6
+
+// unitHexagon is the outline of a hexagon of size 2.
+var unitHexagon = func() (ret [6]vec) {
+	for i := range ret {
+		sin, cos := math.Sincos(float64(i) * math.Pi / 3)
+		ret[i] = vec{float32(cos), float32(sin)}
+	}
+	return ret
+}()
+
+// outlineInto is outline, but writes the corners to v and returns how many
+// there are.
+func outlineInto(v *[maxVertices]vec, shape spec.Shape, size float32) int {
+	switch shape {
+	case spec.ShapeSquare:
+		v[0] = vec{-size / 2, -size / 2}
+		v[1] = vec{size / 2, -size / 2}
+		v[2] = vec{size / 2, size / 2}
+		v[3] = vec{-size / 2, size / 2}
+		return 4
+	case spec.ShapeHexagon:
+		for i, u := range unitHexagon {
+			v[i] = u.scale(size / 2)
+		}
+		return 6
+	}
+	height := float32(math.Sqrt(3)) * size / 2
+	v[0] = vec{-size / 2, -height / 2} // bottom left
+	v[1] = vec{size / 2, -height / 2}  // bottom right
+	v[2] = vec{0, height / 2}          // top
+	return 3
+}
+
+func polygon(t *spec.Triangle) []vec {
+	var b body
+	b.reset(t)
+	return append([]vec(nil), b.polygon()...)
+}
+
+// body is the shape of a triangle at its position in a World, which Step
+// computes once for every triangle instead of for every pair of triangles
+// that may be colliding.
+type body struct {
+	vertices    [maxVertices]vec        // In counter-clockwise order
+	axes        [maxVertices]vec        // Unit normals of the edges
+	extents     [maxVertices][2]float32 // Of the projections of the vertices on axes
+	n           int                     // Number of vertices
+	naxes       int                     // Number of axes, which edges of length 0 have none of
+	center      vec
+	radius      float32 // See boundingRadius
+	inverseMass float32 // See World.inverseMass
+}
+
+func (b *body) reset(t *spec.Triangle) {
+	var (
+		c        = vec{t.X, t.Y}
+		sin, cos = math.Sincos(float64(t.Angle))
+	)
+	b.n = outlineInto(&b.vertices, t.Shape, Size(t))
+	for i, v := range b.vertices[:b.n] {
+		b.vertices[i] = c.add(vec{
+			v.x*float32(cos) - v.y*float32(sin),
+			v.x*float32(sin) + v.y*float32(cos),
+		})
+	}
+	b.naxes = 0
+	for i, v := range b.vertices[:b.n] {
+		if axis, ok := b.vertices[(i+1)%b.n].sub(v).perp().normalize(); ok {
+			b.axes[b.naxes] = axis
+			b.extents[b.naxes][0], b.extents[b.naxes][1] = b.project(axis)
+			b.naxes++
+		}
+	}
+	b.center, b.radius = c, boundingRadius(t)
+}
+
+func (b *body) polygon() []vec { return b.vertices[:b.n] }
+
+// move moves b by d, as its triangle was.
+func (b *body) move(d vec) {
+	b.center = b.center.add(d)
+	for i, axis := range b.axes[:b.naxes] {
+		offset := d.dot(axis)
+		b.extents[i][0] += offset
+		b.extents[i][1] += offset
+	}
+	for i := range b.vertices[:b.n] {
+		b.vertices[i] = b.vertices[i].add(d)
+	}
+}
+
+// boundingRadius is the radius of the smallest circle centered at (t.X, t.Y)
+// that contains t at any orientation.
+func boundingRadius(t *spec.Triangle) float32 {
+	size := Size(t)
+	switch t.Shape {
+	case spec.ShapeSquare:
+		return size / float32(math.Sqrt2)
+	case spec.ShapeHexagon:
+		return size / 2
+	}
+	return vec{size / 2, float32(math.Sqrt(3)) * size / 4}.length()
+}
+
+// area returns the area of t.
+func area(t *spec.Triangle) float32 {
+	size := Size(t)
+	switch t.Shape {
+	case spec.ShapeSquare:
+		return size * size
+	case spec.ShapeHexagon:
+		return 3 * float32(math.Sqrt(3)) * size * size / 8
+	}
+	return float32(math.Sqrt(3)) * size * size / 4
+}
+
+// inertiaPerMass is the moment of inertia of t about its center divided by
+// its mass.
+func inertiaPerMass(t *spec.Triangle) float32 {
+	size := Size(t)
+	switch t.Shape {
+	case spec.ShapeSquare:
+		return size * size / 6
+	case spec.ShapeHexagon:
+		return 5 * size * size / 48
+	}
+	return size * size / 12
+}
+
+// floorHeight is the distance between the center of t and the lowest point
+// of t in its upright orientation, used when bouncing it off the top of the
+// screen.
+func floorHeight(t *spec.Triangle) float32 {
+	size := Size(t)
+	switch t.Shape {
+	case spec.ShapeSquare:
+		return size / 2
+	case spec.ShapeHexagon:
+		return float32(math.Sqrt(3)) * size / 4
+	}
+	return size / (2 * float32(math.Sqrt(3)))
+}
+
+// overlap uses the separating axis theorem to determine whether the convex
+// polygons a and b intersect. If they do, it returns the unit vector along
+// which b should be moved (and a in the opposite direction) to separate them
+// and the distance by which they overlap along it.
+//
+// Swapping a and b negates the normal, unless their centers coincide.
+func overlap(a, b *body) (normal vec, depth float32, ok bool) {
+	depth = float32(math.Inf(1))
+	ab := b.center.sub(a.center)
+	for i, axis := range a.axes[:a.naxes] {
+		minB, maxB := b.project(axis)
+		if !separate(axis, a.extents[i][0], a.extents[i][1], minB, maxB, ab, &normal, &depth) {
+			return vec{}, 0, false
+		}
+	}
+	for i, axis := range b.axes[:b.naxes] {
+		minA, maxA := a.project(axis)
+		if !separate(axis, minA, maxA, b.extents[i][0], b.extents[i][1], ab, &normal, &depth) {
+			return vec{}, 0, false
+		}
+	}
+	return normal, depth, true
+}
+
+// separate returns false if axis separates polygons a and b, whose
+// projections on it are [minA, maxA] and [minB, maxB]. Otherwise, it
+// updates normal and depth if they overlap less along axis than along
+// normal (see shallower).
+func separate(axis vec, minA, maxA, minB, maxB float32, ab vec, normal *vec, depth *float32) bool {
+	if maxA <= minB || maxB <= minA {
+		return false
+	}
+	// Overlap when moving b along +axis, and along -axis.
+	if d := maxA - minB; shallower(axis, d, *normal, *depth, ab) {
+		*depth, *normal = d, axis
+	}
+	if d, n := maxB-minA, axis.scale(-1); shallower(n, d, *normal, *depth, ab) {
+		*depth, *normal = d, n
+	}
+	return true
+}
+
+// shallower returns true if polygons that overlap by d along n overlap less
+// than by depth along normal. Of normals along which they overlap equally,
+// it prefers the one closest to ab, the offset between their centers, and
+// then the one counter-clockwise of the other from ab. Thus the choice does
+// not depend on which axes belong to which polygon, and is the same (but
+// negated) when the polygons are swapped.
+func shallower(n vec, d float32, normal vec, depth float32, ab vec) bool {
+	switch {
+	case d < depth-overlapTolerance:
+		return true
+	case d > depth+overlapTolerance:
+		return false
+	}
+	if dn, dnormal := n.dot(ab), normal.dot(ab); math.Abs(float64(dn-dnormal)) > overlapTolerance {
+		return dn > dnormal
+	}
+	return ab.cross(n) > ab.cross(normal)+overlapTolerance
+}
+
+// overlapTolerance is the difference below which overlap considers depths
+// (and projections on the offset between polygons) equal, as rounding errors
+// differ between the axes of two polygons.
+const overlapTolerance = 1e-6
+
+// support returns the vertex of poly that is furthest along axis.
+func support(poly []vec, axis vec) vec {
+	ret := poly[0]
+	for _, v := range poly[1:] {
+		if v.dot(axis) > ret.dot(axis) {
+			ret = v
+		}
+	}
+	return ret
+}
+
+// project returns the extent of the projection of the vertices of b on axis.
+func (b *body) project(axis vec) (min, max float32) {
+	min = b.vertices[0].dot(axis)
+	max = min
+	for _, v := range b.vertices[1:b.n] {
+		switch p := v.dot(axis); {
+		case p < min:
+			min = p
+		case p > max:
+			max = p
+		}
+	}
+	return min, max
+}
@@ -0,0 +1,154 @@
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+)
+
+// grid is a uniform grid used as the broad phase of collision detection:
+// triangles are only tested for collision with triangles in the same or an
+// adjacent cell, instead of with every other triangle in the World.
+//
+// The cells are at least as large as the diameter of the largest triangle,
+// so triangles that are not in adjacent cells cannot collide. They cover a
+// square of size gridExtent centered on the screen, and triangles outside it
+// are in the cell on its border closest to them.
+//
+// The bodies of the triangles are sorted by cell, so that the bodies of
+// triangles that may collide are close to each other in memory, and the
+// slices backing the grid are reused from one Step to the next.
+type grid struct {
+	size   float32
+	width  int32   // Number of cells along each side
+	start  []int32 // Index in bodies of the first body in each cell, followed by len(bodies)
+	bodies []body  // Of the triangles provided to reset, sorted by cell
+	index  []int32 // Index in the triangles provided to reset of each body
+	cells  []int32 // Cell of each triangle provided to reset
+}
+
+const gridExtent = 4
+
+// reset fills the grid with triangles.
+func (g *grid) reset(triangles []*spec.Triangle) {
+	n := len(triangles)
+	var maxRadius float32
+	for _, t := range triangles {
+		if r := boundingRadius(t); r > maxRadius {
+			maxRadius = r
+		}
+	}
+	// Do not make more cells than there are triangles.
+	g.size = float32(math.Max(float64(2*maxRadius), gridExtent/math.Sqrt(float64(n+1))))
+	g.width = int32(gridExtent/g.size) + 1
+	cells := int(g.width * g.width)
+	g.start = resize(g.start, cells+1)
+	for c := range g.start {
+		g.start[c] = 0
+	}
+	g.cells = resize(g.cells, n)
+	for i, t := range triangles {
+		c := g.cellOf(t)
+		g.cells[i] = c
+		g.start[c+1]++
+	}
+	for c := 0; c < cells; c++ {
+		g.start[c+1] += g.start[c]
+	}
+	// Place the bodies of every cell in the order of their triangles,
+	// using start[c] as the index of the next body of cell c, which
+	// leaves it at the start of cell c+1.
+	g.index = resize(g.index, n)
+	if cap(g.bodies) < n {
+		g.bodies = make([]body, n, 2*n)
+	}
+	g.bodies = g.bodies[:n]
+	for i, t := range triangles {
+		c := g.cells[i]
+		k := g.start[c]
+		g.start[c]++
+		g.index[k] = int32(i)
+		g.bodies[k].reset(t)
+	}
+	copy(g.start[1:], g.start[:cells])
+	g.start[0] = 0
+}
+
+func resize(s []int32, n int) []int32 {
+	if cap(s) < n {
+		return make([]int32, n, 2*n)
+	}
+	return s[:n]
+}
+
+func (g *grid) cellOf(t *spec.Triangle) int32 {
+	return g.coordinate(t.Y)*g.width + g.coordinate(t.X)
+}
+
+func (g *grid) coordinate(f float32) int32 {
+	switch i := floor((f + gridExtent/2) / g.size); {
+	case i < 0:
+		return 0
+	case i >= g.width:
+		return g.width - 1
+	default:
+		return i
+	}
+}
+
+// pairs invokes fn on the indices and bodies of every pair of triangles whose
+// bounding circles overlap. Every pair is visited once, in an order
+// determined by the positions and order of triangles so that the simulation
+// is deterministic.
+//
+// fn may move the bodies (see body.move), which pairs accounts for in the
+// pairs that it visits afterwards.
+func (g *grid) pairs(fn func(i, j int, b1, b2 *body)) {
+	w := g.width
+	for c := int32(0); c < w*w; c++ {
+		// Triangles in the cells before c (in row-major order) were
+		// paired with those in c already.
+		x, y := c%w, c/w
+		forward := [4]int32{-1, -1, -1, -1}
+		if x+1 < w {
+			forward[0] = c + 1
+		}
+		if y+1 < w {
+			forward[1] = c + w
+			if x > 0 {
+				forward[2] = c + w - 1
+			}
+			if x+1 < w {
+				forward[3] = c + w + 1
+			}
+		}
+		for k := g.start[c]; k < g.start[c+1]; k++ {
+			for l := k + 1; l < g.start[c+1]; l++ {
+				g.visit(k, l, fn)
+			}
+			for _, d := range forward {
+				if d < 0 {
+					continue
+				}
+				for l := g.start[d]; l < g.start[d+1]; l++ {
+					g.visit(k, l, fn)
+				}
+			}
+		}
+	}
+}
+
+func (g *grid) visit(k, l int32, fn func(i, j int, b1, b2 *body)) {
+	b1, b2 := &g.bodies[k], &g.bodies[l]
+	d, r := b2.center.sub(b1.center), b1.radius+b2.radius
+	if d.dot(d) < r*r {
+		fn(int(g.index[k]), int(g.index[l]), b1, b2)
+	}
+}
+
+func floor(f float32) int32 {
+	i := int32(f)
+	if f < 0 && float32(i) != f {
+		i--
+	}
+	return i
+}
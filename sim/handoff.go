@@ -0,0 +1,67 @@
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+)
+
+// Handoff transforms t, which went off the edge in direction exit of a screen
+// with geometry from, into the coordinate system of the screen with geometry
+// to that stands in that direction.
+//
+// The two screens are assumed to be physically adjacent, with the point at
+// fromMark along the shared edge of the sending screen (Y for the left and
+// right edges, X for the top and bottom ones) lined up with the point at
+// toMark along the same edge of the receiving screen. Both marks are 0 when
+// the centers of the screens are aligned.
+//
+// Positions and velocities are mapped through physical units (inches), so a
+// triangle keeps its physical size and speed as it crosses the seam, even if
+// the screens differ in size, density or aspect ratio. If the physical
+// dimensions of a screen are unknown, it is assumed to be the same size as
+// the other one, in which case a triangle that went off the left edge of one
+// screen, at X < -1, reappears at X + 2 on the other (with aligned centers).
+func Handoff(t *spec.Triangle, exit spec.Direction, from, to spec.Geometry, fromMark, toMark float32) {
+	fw, fh := inches(from, to)
+	tw, th := inches(to, from)
+	// Half-dimensions, since the screens span [-1, 1] in both dimensions.
+	fw, fh, tw, th = fw/2, fh/2, tw/2, th/2
+	// Position of the center of the receiving screen relative to the
+	// center of the sending one, in inches.
+	var cx, cy float32
+	switch exit {
+	case spec.DirectionLeft:
+		cx, cy = -(fw + tw), fromMark*fh-toMark*th
+	case spec.DirectionRight:
+		cx, cy = fw+tw, fromMark*fh-toMark*th
+	case spec.DirectionAbove:
+		cx, cy = fromMark*fw-toMark*tw, fh+th
+	case spec.DirectionBelow:
+		cx, cy = fromMark*fw-toMark*tw, -(fh + th)
+	}
+	sx, sy := fw/tw, fh/th
+	t.X = (t.X*fw - cx) / tw
+	t.Y = (t.Y*fh - cy) / th
+	t.Dx *= sx
+	t.Dy *= sy
+	// Screen coordinates are not square on screens that are not, so
+	// preserve the area of the triangle.
+	t.Size = Size(t) * float32(math.Sqrt(float64(sx*sy)))
+}
+
+// inches returns the physical dimensions of the screen with geometry g,
+// falling back to those of other if g is unknown and to a unit square if
+// neither is known.
+func inches(g, other spec.Geometry) (w, h float32) {
+	if known(g) {
+		return float32(g.WidthPx) / g.PixelsPerInch, float32(g.HeightPx) / g.PixelsPerInch
+	}
+	if known(other) {
+		return float32(other.WidthPx) / other.PixelsPerInch, float32(other.HeightPx) / other.PixelsPerInch
+	}
+	return 1, 1
+}
+
+func known(g spec.Geometry) bool {
+	return g.WidthPx > 0 && g.HeightPx > 0 && g.PixelsPerInch > 0
+}
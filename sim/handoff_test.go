@@ -0,0 +1,102 @@
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+	"testing"
+)
+
+func TestHandoff(t *testing.T) {
+	var (
+		square  = spec.Geometry{WidthPx: 100, HeightPx: 100, PixelsPerInch: 100} // 1x1 inches
+		wide    = spec.Geometry{WidthPx: 200, HeightPx: 100, PixelsPerInch: 100} // 2x1 inches
+		dense   = spec.Geometry{WidthPx: 200, HeightPx: 200, PixelsPerInch: 200} // 1x1 inches
+		unknown spec.Geometry
+	)
+	tests := []struct {
+		exit     spec.Direction
+		from, to spec.Geometry
+		in, want spec.Triangle
+	}{
+		// Physically twice as wide: half the speed and size across.
+		{spec.DirectionRight, square, wide,
+			spec.Triangle{X: 1, Y: 0.5, Dx: 0.2, Dy: 0.1, Size: 0.1},
+			spec.Triangle{X: -1, Y: 0.5, Dx: 0.1, Dy: 0.1, Size: 0.1 * float32(math.Sqrt(0.5))}},
+		{spec.DirectionLeft, wide, square,
+			spec.Triangle{X: -1, Y: 0.5, Dx: -0.2, Dy: 0.1, Size: 0.1},
+			spec.Triangle{X: 1, Y: 0.5, Dx: -0.4, Dy: 0.1, Size: 0.1 * float32(math.Sqrt(2))}},
+		// The same physical size, at another density.
+		{spec.DirectionAbove, square, dense,
+			spec.Triangle{X: 0.3, Y: 1, Dx: 0.1, Dy: 0.2, Size: 0.1},
+			spec.Triangle{X: 0.3, Y: -1, Dx: 0.1, Dy: 0.2, Size: 0.1}},
+		// Unknown geometries are assumed to match the other screen.
+		{spec.DirectionBelow, unknown, wide,
+			spec.Triangle{X: -0.5, Y: -1, Dx: 0.1, Dy: -0.2, Size: 0.1},
+			spec.Triangle{X: -0.5, Y: 1, Dx: 0.1, Dy: -0.2, Size: 0.1}},
+	}
+	for _, test := range tests {
+		got := test.in
+		Handoff(&got, test.exit, test.from, test.to, 0, 0)
+		if !closeTriangles(got, test.want) {
+			t.Errorf("%v from %+v to %+v: got %+v, want %+v", test.exit, test.from, test.to, got, test.want)
+		}
+	}
+}
+
+// closeTriangles returns true if the positions, velocities and sizes of a and
+// b are equal, give or take rounding errors.
+func closeTriangles(a, b spec.Triangle) bool {
+	const epsilon = 1e-5
+	for _, d := range []float32{a.X - b.X, a.Y - b.Y, a.Dx - b.Dx, a.Dy - b.Dy, a.Size - b.Size} {
+		if math.Abs(float64(d)) > epsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// TestHandoffMarkers checks that a triangle crossing the seam at the marker
+// on one screen enters the other screen at its marker, and that a triangle
+// elsewhere is offset by the same physical distance.
+func TestHandoffMarkers(t *testing.T) {
+	var (
+		square = spec.Geometry{WidthPx: 100, HeightPx: 100, PixelsPerInch: 100} // 1x1 inches
+		tall   = spec.Geometry{WidthPx: 100, HeightPx: 200, PixelsPerInch: 100} // 1x2 inches
+	)
+	tests := []struct {
+		exit             spec.Direction
+		from, to         spec.Geometry
+		fromMark, toMark float32
+		in, want         float32 // Along the shared edge
+	}{
+		{spec.DirectionRight, square, square, 0.4, 0, 0.4, 0},
+		{spec.DirectionRight, square, square, 0.4, 0, 0, -0.4},
+		{spec.DirectionLeft, square, square, 0, -0.3, 0, -0.3},
+		{spec.DirectionLeft, square, square, 0.2, -0.3, 0.7, 0.2},
+		{spec.DirectionAbove, square, square, -0.5, 0.5, -0.5, 0.5},
+		// Half an inch on the square screen is a quarter of the tall one.
+		{spec.DirectionRight, square, tall, 0.5, 0, 0.5, 0},
+		{spec.DirectionRight, square, tall, 0.5, 0, 0, -0.25},
+		{spec.DirectionLeft, tall, square, 0, 0.5, 0.25, 1},
+	}
+	for _, test := range tests {
+		var (
+			tri    spec.Triangle
+			across = &tri.X // Coordinate that goes off the edge
+			along  = &tri.Y // Coordinate along the edge
+		)
+		if test.exit == spec.DirectionAbove || test.exit == spec.DirectionBelow {
+			across, along = along, across
+		}
+		*along = test.in
+		*across = 1
+		if test.exit == spec.DirectionLeft || test.exit == spec.DirectionBelow {
+			*across = -1
+		}
+		Handoff(&tri, test.exit, test.from, test.to, test.fromMark, test.toMark)
+		got := *along
+		if math.Abs(float64(got-test.want)) > 1e-5 {
+			t.Errorf("%v with markers at %v and %v: %v became %v, want %v", test.exit, test.fromMark, test.toMark, test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package sim implements the movement of triangles on a single screen,
+// independently of how they are painted or handed off to other screens.
+//
+// It has no dependency on GL or the network and can thus be exercised on a
+// headless machine.
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+	"time"
+)
+
+// World is the set of triangles owned by a single screen.
+//
+// The coordinate system is the same as that of spec.Triangle, with the
+// visible screen spanning [-1, 1] in both dimensions. Velocities are in those
+// units per second.
+type World struct {
+	Triangles []*spec.Triangle
+	// Restitution is the ratio of the relative speed of two triangles
+	// after and before they collide: 1 for perfectly elastic collisions
+	// and 0 for triangles that stop moving relative to each other.
+	Restitution float32
+	// Mass returns the mass of a triangle. If nil, DefaultMass is used.
+	Mass func(*spec.Triangle) float32
+	// OpenAbove and OpenBelow indicate whether triangles leave the world
+	// through the top and bottom edge respectively (typically because
+	// there is another screen there) instead of bouncing off it.
+	// Triangles always leave through the left and right edges.
+	OpenAbove, OpenBelow bool
+
+	held    map[*spec.Triangle]struct{} // Triangles that should not be moved by Step
+	pending time.Duration               // Time accumulated by Advance but not yet simulated
+	broad   grid                        // Broad phase of collision detection
+}
+
+// Departures are the triangles that left a World during a Step, keyed by
+// the edge they went off, i.e., the direction of the screen they should move
+// on to.
+type Departures map[spec.Direction][]*spec.Triangle
+
+func (d *Departures) add(dir spec.Direction, triangles ...*spec.Triangle) {
+	if len(triangles) == 0 {
+		return
+	}
+	if *d == nil {
+		*d = make(Departures)
+	}
+	(*d)[dir] = append((*d)[dir], triangles...)
+}
+
+// NewWorld returns an empty World.
+func NewWorld() *World {
+	return &World{
+		Restitution: DefaultRestitution,
+		held:        make(map[*spec.Triangle]struct{}),
+	}
+}
+
+// Add adds t to the set of triangles in the world.
+func (w *World) Add(t *spec.Triangle) {
+	w.Triangles = append(w.Triangles, t)
+}
+
+// Hold prevents t from being moved by Step until Release is called, for
+// example while it is being manipulated by the user.
+func (w *World) Hold(t *spec.Triangle) { w.held[t] = struct{}{} }
+
+// Release undoes the effect of Hold.
+func (w *World) Release(t *spec.Triangle) { delete(w.held, t) }
+
+// TriangleAt returns the triangle covering (x, y), or nil if there is none.
+func (w *World) TriangleAt(x, y float32) *spec.Triangle {
+	for _, t := range w.Triangles {
+		if dx, dy, r := (x - t.X), (y - t.Y), Size(t); dx*dx+dy*dy < r*r {
+			return t
+		}
+	}
+	return nil
+}
+
+// Advance advances the world by the wall-clock duration elapsed since the
+// previous call, in fixed increments of Timestep so that the motion of
+// triangles does not depend on how often Advance is called. Time that is not
+// a multiple of Timestep is carried over to the next call, and elapsed is
+// capped at MaxElapsed so that a long pause (e.g., the app being in the
+// background) does not result in a sudden jump.
+func (w *World) Advance(elapsed time.Duration) Departures {
+	if elapsed > MaxElapsed {
+		elapsed = MaxElapsed
+	}
+	w.pending += elapsed
+	var ret Departures
+	for w.pending >= Timestep {
+		w.pending -= Timestep
+		for dir, triangles := range w.Step(TimestepSeconds) {
+			ret.add(dir, triangles...)
+		}
+	}
+	return ret
+}
+
+// Step advances the world by dt seconds: collisions between triangles are
+// resolved, all triangles that are not held are moved and the ones that went
+// off an edge are removed from the world and returned.
+func (w *World) Step(dt float32) Departures {
+	var (
+		ret  Departures
+		mine = w.Triangles[:0]
+	)
+	w.broad.reset(w.Triangles)
+	for k := range w.broad.bodies {
+		w.broad.bodies[k].inverseMass = w.inverseMass(w.Triangles[w.broad.index[k]])
+	}
+	w.broad.pairs(func(i, j int, b1, b2 *body) {
+		w.collide(w.Triangles[i], w.Triangles[j], b1, b2)
+	})
+	for _, t := range w.Triangles {
+		if _, held := w.held[t]; !held {
+			move(t, dt, !w.OpenAbove, !w.OpenBelow)
+		}
+		switch {
+		case t.X < -1:
+			ret.add(spec.DirectionLeft, t)
+		case t.X > 1:
+			ret.add(spec.DirectionRight, t)
+		case t.Y > 1:
+			ret.add(spec.DirectionAbove, t)
+		case t.Y < -1:
+			ret.add(spec.DirectionBelow, t)
+		default:
+			mine = append(mine, t)
+		}
+	}
+	for i := len(mine); i < len(w.Triangles); i++ {
+		// Do not retain pointers to departed triangles in the backing array.
+		w.Triangles[i] = nil
+	}
+	w.Triangles = mine
+	return ret
+}
+
+// Reflect turns t, which went off the edge in direction exit of the screen but
+// could not move on to another screen, back onto the screen and advances it by
+// dt seconds under the influence of gravity.
+//
+// t is put back on the edge it went off and is not bounced off that edge, which
+// would turn it right back towards it.
+func Reflect(t *spec.Triangle, exit spec.Direction, dt float32) {
+	switch exit {
+	case spec.DirectionLeft:
+		t.Dx = float32(math.Abs(float64(t.Dx)))
+		t.X = float32(math.Max(float64(t.X), -1))
+		move(t, dt, true, true)
+	case spec.DirectionRight:
+		t.Dx = -float32(math.Abs(float64(t.Dx)))
+		t.X = float32(math.Min(float64(t.X), 1))
+		move(t, dt, true, true)
+	case spec.DirectionAbove:
+		t.Dy = -float32(math.Abs(float64(t.Dy)))
+		t.Y = float32(math.Min(float64(t.Y), 1))
+		move(t, dt, false, true)
+	case spec.DirectionBelow:
+		t.Dy = float32(math.Abs(float64(t.Dy)))
+		t.Y = float32(math.Max(float64(t.Y), -1))
+		move(t, dt, true, false)
+	}
+}
+
+func move(t *spec.Triangle, dt float32, bounceTop, bounceBottom bool) {
+	t.Dy = t.Dy - Gravity*dt
+	t.X = t.X + t.Dx*dt
+	t.Y = t.Y + t.Dy*dt
+	t.Angle = float32(math.Remainder(float64(t.Angle+t.Omega*dt), 2*math.Pi))
+	if bounceBottom && t.Y <= -1 {
+		t.Dy = -1 * t.Dy
+		t.Y = -1
+	} else if maxY := 1 - floorHeight(t); bounceTop && t.Y >= maxY {
+		t.Dy = -1 * t.Dy
+		t.Y = maxY
+	}
+}
+
+const (
+	// DefaultSize is the size of triangles that do not specify one, in a
+	// coordinate system where the full screen is of size 2 ([-1, 1]).
+	DefaultSize float32 = 0.4
+	// Gravity is the downward acceleration applied to every triangle, in
+	// screen units per second per second.
+	Gravity = 0.36
+	// Timestep is the granularity at which Advance simulates the world.
+	Timestep = time.Second / 120
+	// TimestepSeconds is Timestep in the units expected by Step and Move.
+	TimestepSeconds = float32(Timestep) / float32(time.Second)
+	// MaxElapsed is the maximum amount of time simulated by a single call
+	// to Advance.
+	MaxElapsed = time.Second / 4
+)
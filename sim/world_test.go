@@ -0,0 +1,207 @@
+package sim
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestReflect(t *testing.T) {
+	tests := []struct {
+		exit spec.Direction
+		t    spec.Triangle
+	}{
+		{spec.DirectionLeft, spec.Triangle{X: -1.001, Dx: -0.5}},
+		{spec.DirectionRight, spec.Triangle{X: 1.001, Dx: 0.5}},
+		{spec.DirectionAbove, spec.Triangle{Y: 1.001, Dy: 0.5}},
+		{spec.DirectionBelow, spec.Triangle{Y: -1.001, Dy: -0.5}},
+	}
+	for _, test := range tests {
+		tri := test.t
+		Reflect(&tri, test.exit, TimestepSeconds)
+		// The triangle must stay on the screen, even if the screen
+		// it went off towards is still there.
+		w := NewWorld()
+		w.OpenAbove, w.OpenBelow = true, true
+		w.Add(&tri)
+		for i := 0; i < int(time.Second/Timestep); i++ {
+			if d := w.Step(TimestepSeconds); len(d[test.exit]) > 0 {
+				t.Errorf("%v: went off the %v edge again after %d steps: %+v", test.exit, test.exit, i, tri)
+				break
+			}
+		}
+	}
+}
+
+func TestStep(t *testing.T) {
+	const dt = TimestepSeconds
+	none := spec.Direction(-1)
+	tests := []struct {
+		name                 string
+		openAbove, openBelow bool
+		held                 bool
+		t                    spec.Triangle
+		want                 spec.Triangle
+		departs              spec.Direction // none if the triangle stays
+	}{
+		{
+			name:    "gravity",
+			want:    spec.Triangle{Y: -Gravity * dt * dt, Dy: -Gravity * dt},
+			departs: none,
+		},
+		{
+			name:    "drift",
+			t:       spec.Triangle{X: 0.5, Dx: 0.6},
+			want:    spec.Triangle{X: 0.5 + 0.6*dt, Y: -Gravity * dt * dt, Dx: 0.6, Dy: -Gravity * dt},
+			departs: none,
+		},
+		{
+			name:    "held",
+			held:    true,
+			t:       spec.Triangle{X: 0.5, Dx: 0.6},
+			want:    spec.Triangle{X: 0.5, Dx: 0.6},
+			departs: none,
+		},
+		{
+			name:    "floor bounce",
+			t:       spec.Triangle{Y: -0.999, Dy: -1},
+			want:    spec.Triangle{Y: -1, Dy: 1 + Gravity*dt},
+			departs: none,
+		},
+		{
+			name:    "ceiling bounce",
+			t:       spec.Triangle{Y: 0.884, Dy: 1},
+			want:    spec.Triangle{Y: 1 - floorHeight(&spec.Triangle{}), Dy: -(1 - Gravity*dt)},
+			departs: none,
+		},
+		{
+			name:    "left",
+			t:       spec.Triangle{X: -0.999, Dx: -1},
+			want:    spec.Triangle{X: -0.999 - dt, Y: -Gravity * dt * dt, Dx: -1, Dy: -Gravity * dt},
+			departs: spec.DirectionLeft,
+		},
+		{
+			name:    "right",
+			t:       spec.Triangle{X: 0.999, Dx: 1},
+			want:    spec.Triangle{X: 0.999 + dt, Y: -Gravity * dt * dt, Dx: 1, Dy: -Gravity * dt},
+			departs: spec.DirectionRight,
+		},
+		{
+			name:      "above",
+			openAbove: true,
+			t:         spec.Triangle{Y: 0.999, Dy: 1},
+			want:      spec.Triangle{Y: 0.999 + (1-Gravity*dt)*dt, Dy: 1 - Gravity*dt},
+			departs:   spec.DirectionAbove,
+		},
+		{
+			name:      "below",
+			openBelow: true,
+			t:         spec.Triangle{Y: -0.999, Dy: -1},
+			want:      spec.Triangle{Y: -0.999 - (1+Gravity*dt)*dt, Dy: -1 - Gravity*dt},
+			departs:   spec.DirectionBelow,
+		},
+	}
+	near := func(a, b float32) bool { return math.Abs(float64(a-b)) < 1e-6 }
+	for _, test := range tests {
+		var (
+			w   = NewWorld()
+			tri = test.t
+		)
+		w.OpenAbove, w.OpenBelow = test.openAbove, test.openBelow
+		w.Add(&tri)
+		if test.held {
+			w.Hold(&tri)
+		}
+		departures := w.Step(dt)
+		if !near(tri.X, test.want.X) || !near(tri.Y, test.want.Y) || !near(tri.Dx, test.want.Dx) || !near(tri.Dy, test.want.Dy) {
+			t.Errorf("%v: got position (%v, %v) and velocity (%v, %v), want (%v, %v) and (%v, %v)", test.name, tri.X, tri.Y, tri.Dx, tri.Dy, test.want.X, test.want.Y, test.want.Dx, test.want.Dy)
+		}
+		for _, dir := range spec.DirectionAll {
+			if n := len(departures[dir]); n > 0 && dir != test.departs {
+				t.Errorf("%v: %d triangles went off the %v edge", test.name, n, dir)
+			}
+		}
+		if test.departs == none {
+			if len(w.Triangles) != 1 {
+				t.Errorf("%v: triangle left the world", test.name)
+			}
+		} else if len(departures[test.departs]) != 1 || len(w.Triangles) != 0 {
+			t.Errorf("%v: triangle did not go off the %v edge", test.name, test.departs)
+		}
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	const dx = 0.6
+	tests := []struct {
+		name    string
+		elapsed []time.Duration // Passed to successive calls to Advance
+		steps   int
+		pending time.Duration // Left over for the next call
+	}{
+		{"nothing", []time.Duration{0}, 0, 0},
+		{"one timestep", []time.Duration{Timestep}, 1, 0},
+		{"less than a timestep", []time.Duration{Timestep / 2}, 0, Timestep / 2},
+		{"carried over", []time.Duration{Timestep / 2, Timestep - Timestep/2}, 1, 0},
+		{"leftover carried over", []time.Duration{Timestep + Timestep/3, Timestep / 3}, 1, 2 * (Timestep / 3)},
+		{"leftover completes a timestep", []time.Duration{Timestep + Timestep/3, Timestep - Timestep/3}, 2, 0},
+		{"several timesteps", []time.Duration{5*Timestep + 1}, 5, 1},
+		{"clamped", []time.Duration{time.Minute}, int(MaxElapsed / Timestep), MaxElapsed % Timestep},
+		{"clamped after leftover", []time.Duration{Timestep / 2, time.Minute}, int((Timestep/2 + MaxElapsed) / Timestep), (Timestep/2 + MaxElapsed) % Timestep},
+		{"clamped every call", []time.Duration{time.Minute, time.Minute}, int(2 * MaxElapsed / Timestep), 2 * MaxElapsed % Timestep},
+	}
+	for _, test := range tests {
+		var (
+			w   = NewWorld()
+			tri = spec.Triangle{Dx: dx}
+		)
+		w.Add(&tri)
+		for _, elapsed := range test.elapsed {
+			w.Advance(elapsed)
+		}
+		// The triangle drifts by the same amount on every step.
+		if steps := int(math.Floor(float64(tri.X/(dx*TimestepSeconds)) + 0.5)); steps != test.steps {
+			t.Errorf("%v: simulated %d timesteps, want %d", test.name, steps, test.steps)
+		}
+		if w.pending != test.pending {
+			t.Errorf("%v: %v left over, want %v", test.name, w.pending, test.pending)
+		}
+	}
+}
+
+func BenchmarkStep100(b *testing.B)   { benchmarkStep(b, 100) }
+func BenchmarkStep1000(b *testing.B)  { benchmarkStep(b, 1000) }
+func BenchmarkStep10000(b *testing.B) { benchmarkStep(b, 10000) }
+
+// benchmarkStep measures Step on a World of n triangles, scattered across the
+// screen and sized so that they cover as much of it as 100 triangles of
+// DefaultSize do.
+func benchmarkStep(b *testing.B, n int) {
+	var (
+		w      = NewWorld()
+		random = rand.New(rand.NewSource(1))
+		size   = DefaultSize * float32(math.Sqrt(100/float64(n)))
+	)
+	for i := 0; i < n; i++ {
+		w.Add(&spec.Triangle{
+			X:     random.Float32()*2 - 1,
+			Y:     random.Float32()*2 - 1,
+			Dx:    random.Float32()*4 - 2,
+			Dy:    random.Float32()*4 - 2,
+			Omega: random.Float32()*2 - 1,
+			Size:  size,
+		})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Keep the number of triangles constant.
+		for dir, triangles := range w.Step(TimestepSeconds) {
+			for _, t := range triangles {
+				Reflect(t, dir, 0)
+				w.Add(t)
+			}
+		}
+	}
+}
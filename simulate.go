@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/asimshankar/triangles/sim"
+	"github.com/asimshankar/triangles/spec"
+	"github.com/pborman/uuid"
+	"golang.org/x/mobile/event/size"
+	"log"
+	"math/rand"
+	"time"
+)
+
+var (
+	flagSimulate          = flag.Int("simulate", 0, "If positive, the number of screens to simulate in this process, linked in a row over an in-memory transport, instead of running a screen")
+	flagSimulateSteps     = flag.Int("simulate-steps", 10*int(time.Second/sim.Timestep), "Number of timesteps for which --simulate runs the screens")
+	flagSimulateTriangles = flag.Int("simulate-triangles", 4, "Number of triangles spawned on every screen simulated by --simulate")
+)
+
+// SimulationReport is the outcome of simulate.
+type SimulationReport struct {
+	Spawned int   // Triangles spawned on all screens
+	Links   int   // Pairs of adjacent screens
+	Counts  []int // Triangles on each screen at the end
+}
+
+func (r SimulationReport) String() string {
+	total := 0
+	for _, n := range r.Counts {
+		total += n
+	}
+	return fmt.Sprintf("%d screens (%d links), %d triangles spawned, %d at the end: %v", len(r.Counts), r.Links, r.Spawned, total, r.Counts)
+}
+
+// simulate runs n screens in this process for the provided number of
+// timesteps, each with its own networkManager, sim.World and Headless
+// renderer, linked over a memNetwork. Every screen but the last invites
+// another one to stand on its right (the last one too with --ring, closing
+// the row into a ring), and perScreen triangles are spawned on every screen
+// before the first step.
+//
+// The screens are advanced in lockstep, by sim.TimestepSeconds per step
+// regardless of how long a step takes, so triangles move the same way (if
+// not necessarily between the same screens) on every run. Triangles handed
+// off between screens are in flight concurrently with the steps, so once
+// all steps are done, simulate waits for them to land before counting the
+// triangles on every screen. It returns an error if the screens do not link
+// up, or if the total differs from the number of triangles spawned.
+func simulate(n, steps, perScreen int) (SimulationReport, error) {
+	var (
+		network = newMemNetwork()
+		screens = make([]*simulatedScreen, n)
+		links   = n - 1 // Expected once the screens have linked up
+		random  = rand.New(rand.NewSource(1))
+		report  = SimulationReport{Counts: make([]int, n)}
+	)
+	for i := range screens {
+		invite := "right"
+		if i == n-1 && !*flagRing {
+			invite = ""
+		}
+		screens[i] = newSimulatedScreen(network.NewTransport(), invite)
+		defer screens[i].close()
+	}
+	if *flagRing && n > 1 {
+		links = n
+	}
+	for _, s := range screens {
+		if err := s.waitReady(); err != nil {
+			return report, err
+		}
+	}
+	// Wait for the screens to link up.
+	for start := time.Now(); countLinks(screens) < links && time.Since(start) < maxSimulatedLinkTime; {
+		time.Sleep(simulatedPollInterval)
+	}
+	if report.Links = countLinks(screens); report.Links != links {
+		return report, fmt.Errorf("%d of %d links made after %v", report.Links, links, maxSimulatedLinkTime)
+	}
+	for _, s := range screens {
+		s.do(func() {
+			for i := 0; i < perScreen; i++ {
+				s.spawn(random.Float32()*2-1, random.Float32()*2-1, random.Float32()*4-2)
+			}
+		})
+		report.Spawned += perScreen
+	}
+	for i := 0; i < steps; i++ {
+		for _, s := range screens {
+			s.do(s.step)
+		}
+	}
+	// Wait for the triangles in flight to land.
+	total, last, lastChange := 0, -1, time.Now()
+	for time.Since(lastChange) < simulatedQuietTime {
+		total = 0
+		for i, s := range screens {
+			s.do(func() { report.Counts[i] = len(s.world.Triangles) })
+			total += report.Counts[i]
+		}
+		if total != last {
+			last, lastChange = total, time.Now()
+		}
+		if total == report.Spawned {
+			break
+		}
+		time.Sleep(simulatedPollInterval)
+	}
+	if total != report.Spawned {
+		return report, fmt.Errorf("%d triangles were spawned but %d remain", report.Spawned, total)
+	}
+	return report, nil
+}
+
+func countLinks(screens []*simulatedScreen) int {
+	links := 0
+	for _, s := range screens {
+		s.do(func() { links += s.links })
+	}
+	// Every link is counted by the screens on both ends of it.
+	return links / 2
+}
+
+// simulatedScreen plays the part of main for a screen run by simulate.
+//
+// All its state is owned by the goroutine running loop, other goroutines
+// access it through do.
+type simulatedScreen struct {
+	id           string // Origin of the triangles spawned on the screen
+	world        *sim.World
+	renderer     *Headless
+	scene        Scene
+	links        int // Number of other screens adjacent to this one
+	chMyScreen   chan *spec.Triangle
+	otherScreens map[spec.Direction]*otherScreen
+	net          NetworkChannels
+
+	ready chan error
+	calls chan func()
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+func newSimulatedScreen(transport Transport, invite string) *simulatedScreen {
+	sz := size.Event{WidthPx: simulatedWidthPx, HeightPx: simulatedHeightPx, PixelsPerPt: 1}
+	s := &simulatedScreen{
+		id:           uuid.New(),
+		world:        sim.NewWorld(),
+		renderer:     NewHeadless(sz.WidthPx, sz.HeightPx),
+		scene:        Scene{Size: sz},
+		chMyScreen:   make(chan *spec.Triangle),
+		otherScreens: make(map[spec.Direction]*otherScreen),
+		ready:        make(chan error, 1),
+		calls:        make(chan func()),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, dir := range spec.DirectionAll {
+		s.otherScreens[dir] = newOtherScreen(dir, nil, s.chMyScreen)
+	}
+	s.net = setupNetwork(transport, invite, "", s.chMyScreen)
+	s.net.Resize(sz)
+	go s.loop()
+	return s
+}
+
+func (s *simulatedScreen) loop() {
+	defer close(s.done)
+	for {
+		select {
+		case ready := <-s.net.Ready:
+			switch v := ready.(type) {
+			case error:
+				s.ready <- v
+			case Color:
+				s.scene.TopBanner = v
+				s.ready <- nil
+			}
+			s.net.Ready = nil
+		case inv := <-s.net.Invitations:
+			// Respond asynchronously, as the networkManager may be
+			// busy notifying this screen of a neighbour.
+			go func() { inv.Response <- nil }()
+		case <-s.net.Pairings:
+			// Invitations are accepted without confirming their
+			// pairing codes.
+		case c := <-s.net.Candidates:
+			// With --pick, pick every screen as it is discovered.
+			if !c.Lost {
+				s.net.Pick(c.Direction, c.Id)
+			}
+		case n := <-s.net.Neighbours:
+			s.otherScreens[n.Direction].close()
+			s.otherScreens[n.Direction] = newOtherScreen(n.Direction, n.Triangles, s.chMyScreen)
+			if n.Triangles != nil {
+				s.links++
+			} else {
+				s.links--
+			}
+			switch n.Direction {
+			case spec.DirectionAbove:
+				s.world.OpenAbove = n.Triangles != nil
+			case spec.DirectionBelow:
+				s.world.OpenBelow = n.Triangles != nil
+			}
+		case t := <-s.chMyScreen:
+			s.world.Add(t)
+		case f := <-s.calls:
+			f()
+		case <-s.quit:
+			for _, o := range s.otherScreens {
+				o.close()
+			}
+			closeNetwork(s.net, s.chMyScreen)
+			return
+		}
+	}
+}
+
+// do runs f on the goroutine that owns the state of s.
+func (s *simulatedScreen) do(f func()) {
+	done := make(chan struct{})
+	s.calls <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+func (s *simulatedScreen) waitReady() error {
+	select {
+	case err := <-s.ready:
+		return err
+	case <-time.After(maxSimulatedLinkTime):
+		return fmt.Errorf("screen not ready after %v", maxSimulatedLinkTime)
+	}
+}
+
+// spawn adds a triangle at (x, y) moving horizontally at dx.
+func (s *simulatedScreen) spawn(x, y, dx float32) {
+	c := s.scene.TopBanner
+	t := &spec.Triangle{
+		X: x, Y: y, Dx: dx, R: c.R, G: c.G, B: c.B, Size: sim.DefaultSize,
+		Id: uuid.New(), Origin: s.id}
+	trace(t, "spawned")
+	s.world.Add(t)
+}
+
+// step advances the world by one timestep, hands off the triangles that
+// left it and paints it.
+func (s *simulatedScreen) step() {
+	for dir, triangles := range s.world.Step(sim.TimestepSeconds) {
+		go s.otherScreens[dir].send(triangles)
+	}
+	s.scene.Triangles = s.world.Triangles
+	s.renderer.Paint(s.scene)
+}
+
+func (s *simulatedScreen) close() {
+	close(s.quit)
+	<-s.done
+}
+
+// runSimulation runs simulate with the parameters provided by command-line
+// flags and logs the result.
+func runSimulation() error {
+	report, err := simulate(*flagSimulate, *flagSimulateSteps, *flagSimulateTriangles)
+	log.Printf("Simulated %v", report)
+	return err
+}
+
+const (
+	simulatedWidthPx      = 160
+	simulatedHeightPx     = 120
+	simulatedPollInterval = 10 * time.Millisecond
+	// Bounds on the time for which simulate waits for the screens to link
+	// up and for the triangles in flight to land.
+	maxSimulatedLinkTime = 5 * time.Second
+	simulatedQuietTime   = 2 * maxTriangleGiveTime
+)
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+// testSimulate simulates n screens and checks that they made links links and
+// did not lose or duplicate any triangle.
+func testSimulate(t *testing.T, n, links int) {
+	report, err := simulate(n, 50, 5)
+	if err != nil {
+		t.Errorf("%d screens: %v (%v)", n, err, report)
+		return
+	}
+	if report.Links != links {
+		t.Errorf("%d screens: got %d links, want %d", n, report.Links, links)
+	}
+	total := 0
+	for _, c := range report.Counts {
+		total += c
+	}
+	if total != report.Spawned {
+		t.Errorf("%d screens: %d triangles spawned but %d remain", n, report.Spawned, total)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	for _, n := range []int{1, 2, 3} {
+		testSimulate(t, n, n-1)
+	}
+}
+
+// TestSimulateRing runs rings of up to three screens, which cannot close
+// before every screen joined them (see sendInvites).
+func TestSimulateRing(t *testing.T) {
+	*flagRing = true
+	defer func() { *flagRing = false }()
+	for _, n := range []int{2, 3} {
+		testSimulate(t, n, n)
+	}
+}
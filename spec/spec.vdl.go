@@ -9,6 +9,8 @@ package spec
 
 import (
 	// VDL system imports
+	"fmt"
+	"io"
 	"v.io/v23"
 	"v.io/v23/context"
 	"v.io/v23/rpc"
@@ -19,16 +21,37 @@ import (
 //
 // The coordinates (X, Y) and velocity (Dx, Dy) are in a world where (0, 0) is
 // the center, (1, 1) is the bottom right and (-1, -1) is the top left.
+// Velocities are measured in those units per second.
+//
+// Angle is the orientation of the triangle in radians, counter-clockwise from
+// upright, and Omega is its angular velocity in radians per second.
+//
+// Size is the width of the shape in the same units as X and Y (for a
+// triangle, the length of its sides) and Shape is the kind of polygon it is
+// drawn as. A Size of 0 denotes the default size.
 //
 // R, G, B denote the color of the triangle.
+//
+// Id uniquely identifies the triangle across all screens and Origin
+// identifies the screen that created it. Hops is the number of times the
+// triangle has been handed off from one screen to another, which lets a
+// screen that is given the same triangle more than once for the same hop
+// (e.g., by a retried Give) drop the duplicates.
 type Triangle struct {
-	X  float32
-	Y  float32
-	Dx float32
-	Dy float32
-	R  float32
-	G  float32
-	B  float32
+	X      float32
+	Y      float32
+	Dx     float32
+	Dy     float32
+	R      float32
+	G      float32
+	B      float32
+	Angle  float32
+	Omega  float32
+	Size   float32
+	Shape  Shape
+	Id     string
+	Origin string
+	Hops   int32
 }
 
 func (Triangle) __VDLReflect(struct {
@@ -36,22 +59,177 @@ func (Triangle) __VDLReflect(struct {
 }) {
 }
 
+// Shape is the kind of polygon a Triangle is drawn as. Despite the name of
+// the Triangle type, it need not be a triangle.
+type Shape int
+
+const (
+	ShapeTriangle Shape = iota
+	ShapeSquare
+	ShapeHexagon
+)
+
+// ShapeAll holds all labels for Shape.
+var ShapeAll = [...]Shape{ShapeTriangle, ShapeSquare, ShapeHexagon}
+
+// ShapeFromString creates a Shape from a string label.
+func ShapeFromString(label string) (x Shape, err error) {
+	err = x.Set(label)
+	return
+}
+
+// Set assigns label to x.
+func (x *Shape) Set(label string) error {
+	switch label {
+	case "Triangle", "triangle":
+		*x = ShapeTriangle
+		return nil
+	case "Square", "square":
+		*x = ShapeSquare
+		return nil
+	case "Hexagon", "hexagon":
+		*x = ShapeHexagon
+		return nil
+	}
+	*x = -1
+	return fmt.Errorf("unknown label %q in spec.Shape", label)
+}
+
+// String returns the string label of x.
+func (x Shape) String() string {
+	switch x {
+	case ShapeTriangle:
+		return "Triangle"
+	case ShapeSquare:
+		return "Square"
+	case ShapeHexagon:
+		return "Hexagon"
+	}
+	return ""
+}
+
+func (Shape) __VDLReflect(struct {
+	Name string `vdl:"github.com/asimshankar/triangles/spec.Shape"`
+	Enum struct{ Triangle, Square, Hexagon string }
+}) {
+}
+
+// Direction is the position of a screen relative to another.
+type Direction int
+
+const (
+	DirectionLeft Direction = iota
+	DirectionRight
+	DirectionAbove
+	DirectionBelow
+)
+
+// DirectionAll holds all labels for Direction.
+var DirectionAll = [...]Direction{DirectionLeft, DirectionRight, DirectionAbove, DirectionBelow}
+
+// DirectionFromString creates a Direction from a string label.
+func DirectionFromString(label string) (x Direction, err error) {
+	err = x.Set(label)
+	return
+}
+
+// Set assigns label to x.
+func (x *Direction) Set(label string) error {
+	switch label {
+	case "Left", "left":
+		*x = DirectionLeft
+		return nil
+	case "Right", "right":
+		*x = DirectionRight
+		return nil
+	case "Above", "above":
+		*x = DirectionAbove
+		return nil
+	case "Below", "below":
+		*x = DirectionBelow
+		return nil
+	}
+	*x = -1
+	return fmt.Errorf("unknown label %q in spec.Direction", label)
+}
+
+// String returns the string label of x.
+func (x Direction) String() string {
+	switch x {
+	case DirectionLeft:
+		return "Left"
+	case DirectionRight:
+		return "Right"
+	case DirectionAbove:
+		return "Above"
+	case DirectionBelow:
+		return "Below"
+	}
+	return ""
+}
+
+func (Direction) __VDLReflect(struct {
+	Name string `vdl:"github.com/asimshankar/triangles/spec.Direction"`
+	Enum struct{ Left, Right, Above, Below string }
+}) {
+}
+
+// Geometry describes the physical dimensions of a screen, which are used to
+// transform the coordinates of triangles moving between screens of different
+// sizes and aspect ratios so that they move smoothly across the seam.
+type Geometry struct {
+	WidthPx       int32   // Size of the screen in pixels
+	HeightPx      int32   // Size of the screen in pixels
+	PixelsPerInch float32 // Pixel density, 0 if unknown
+}
+
+func (Geometry) __VDLReflect(struct {
+	Name string `vdl:"github.com/asimshankar/triangles/spec.Geometry"`
+}) {
+}
+
 func init() {
 	vdl.Register((*Triangle)(nil))
+	vdl.Register((*Shape)(nil))
+	vdl.Register((*Direction)(nil))
+	vdl.Register((*Geometry)(nil))
 }
 
+// Version identifies the revision of the types and interfaces in this
+// package. Screens only invite screens that advertise the same Version.
+//
+// Version 2 added Angle and Omega to Triangle.
+// Version 3 added Size and Shape to Triangle.
+// Version 4 added the direction to Screen.Invite.
+// Version 5 added the exchange of Geometry to Screen.Invite.
+// Version 6 added Screen.Align.
+// Version 7 added Screen.GiveAll.
+// Version 8 added Id, Origin and Hops to Triangle.
+// Version 9 added the row to Screen.Invite and Screen.JoinRow.
+// Version 10 added the Geometry of the caller to Screen.Align.
+const Version = int32(10)
+
 // ScreenClientMethods is the client interface
 // containing Screen methods.
 //
 // Screen represents a remote screen that can be invited to grab triangles.
 type ScreenClientMethods interface {
 	// Invite is a request to the receiver to join the set of screens that
-	// the caller is participating in, by standing to the right of the
-	// caller.
+	// the caller is participating in, by standing in the provided
+	// direction of the caller. For example, if direction is Right, then
+	// the receiver is to the right of the caller (and the caller is to
+	// the left of the receiver).
+	//
+	// The caller provides its Geometry and the receiver returns its own.
 	//
-	// A Screen can be active on at most one invitation at a time and
-	// should return an error if it is engaged in a previous invitation.
-	Invite(*context.T, ...rpc.CallOpt) error
+	// row identifies the row of screens that the caller belongs to (see
+	// JoinRow), so that the receiver can refuse to join a row that it
+	// already belongs to.
+	//
+	// A Screen can have at most one neighbour in each direction and
+	// should return an error if it already has one where the caller would
+	// stand.
+	Invite(_ *context.T, direction Direction, inviter Geometry, row string, _ ...rpc.CallOpt) (Geometry, error)
 	// Give is a request by the caller for the receiver to take ownership
 	// of the provided triangle.
 	//
@@ -60,6 +238,31 @@ type ScreenClientMethods interface {
 	// a requirement and Give can be invoked by an arbitrary client to
 	// manufacture a new triangle.
 	Give(_ *context.T, t Triangle, _ ...rpc.CallOpt) error
+	// GiveAll is a request by the caller for the receiver to take ownership
+	// of the batches of triangles sent on the stream, in the same way as
+	// Give.
+	//
+	// The receiver acknowledges every batch, once it has taken ownership of
+	// all the triangles in it, by sending the number of triangles in the
+	// batch. Callers limit the number of batches sent but not yet
+	// acknowledged, so that a slow receiver pushes back on the caller.
+	GiveAll(*context.T, ...rpc.CallOpt) (ScreenGiveAllClientCall, error)
+	// Align informs the receiver of the position of a marker that the user
+	// lined up with a marker on the receiver, along the edge that the
+	// caller shares with the receiver. side is the position of the caller
+	// relative to the receiver and marker is in the caller's coordinates
+	// (Y for screens on the left or right, X for screens above or below).
+	// The receiver uses it to place triangles given to it at the same height
+	// (or horizontal position) at which they left the caller, even if the
+	// two screens are not aligned. geometry is that of the caller, which
+	// calls Align again whenever its size changes.
+	Align(_ *context.T, side Direction, marker float32, geometry Geometry, _ ...rpc.CallOpt) error
+	// JoinRow informs the receiver, which stands on the right of the
+	// caller, that the row of screens linked from left to right that they
+	// both belong to is now identified by head, the leftmost screen in it.
+	// Every screen passes it on to the screen on its right whenever the
+	// row it belongs to changes.
+	JoinRow(_ *context.T, head string, _ ...rpc.CallOpt) error
 }
 
 // ScreenClientStub adds universal methods to ScreenClientMethods.
@@ -77,8 +280,8 @@ type implScreenClientStub struct {
 	name string
 }
 
-func (c implScreenClientStub) Invite(ctx *context.T, opts ...rpc.CallOpt) (err error) {
-	err = v23.GetClient(ctx).Call(ctx, c.name, "Invite", nil, nil, opts...)
+func (c implScreenClientStub) Invite(ctx *context.T, i0 Direction, i1 Geometry, i2 string, opts ...rpc.CallOpt) (o0 Geometry, err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "Invite", []interface{}{i0, i1, i2}, []interface{}{&o0}, opts...)
 	return
 }
 
@@ -87,18 +290,148 @@ func (c implScreenClientStub) Give(ctx *context.T, i0 Triangle, opts ...rpc.Call
 	return
 }
 
+func (c implScreenClientStub) GiveAll(ctx *context.T, opts ...rpc.CallOpt) (ocall ScreenGiveAllClientCall, err error) {
+	var call rpc.ClientCall
+	if call, err = v23.GetClient(ctx).StartCall(ctx, c.name, "GiveAll", nil, opts...); err != nil {
+		return
+	}
+	ocall = &implScreenGiveAllClientCall{ClientCall: call}
+	return
+}
+
+func (c implScreenClientStub) Align(ctx *context.T, i0 Direction, i1 float32, i2 Geometry, opts ...rpc.CallOpt) (err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "Align", []interface{}{i0, i1, i2}, nil, opts...)
+	return
+}
+
+func (c implScreenClientStub) JoinRow(ctx *context.T, i0 string, opts ...rpc.CallOpt) (err error) {
+	err = v23.GetClient(ctx).Call(ctx, c.name, "JoinRow", []interface{}{i0}, nil, opts...)
+	return
+}
+
+// ScreenGiveAllClientStream is the client stream for Screen.GiveAll.
+type ScreenGiveAllClientStream interface {
+	// RecvStream returns the receiver side of the Screen.GiveAll client stream.
+	RecvStream() interface {
+		// Advance stages an item so that it may be retrieved via Value.  Returns
+		// true iff there is an item to retrieve.  Advance must be called before
+		// Value is called.  May block if an item is not available.
+		Advance() bool
+		// Value returns the item that was staged by Advance.  May panic if Advance
+		// returned false or was not called.  Never blocks.
+		Value() int32
+		// Err returns any error encountered by Advance.  Never blocks.
+		Err() error
+	}
+	// SendStream returns the send side of the Screen.GiveAll client stream.
+	SendStream() interface {
+		// Send places the item onto the output stream.  Returns errors
+		// encountered while sending, or if Send is called after Close or
+		// the stream has been canceled.  Blocks if there is no buffer
+		// space; will unblock when buffer space is available or after
+		// the stream has been canceled.
+		Send(item []Triangle) error
+		// Close indicates to the server that no more items will be sent;
+		// server Recv calls will receive io.EOF after all sent items.
+		// This is an optional call - e.g. a client might call Close if it
+		// needs to continue receiving items from the server after it's
+		// done sending.  Returns errors encountered while closing, or if
+		// Close is called after the stream has been canceled.  Like Send,
+		// Close blocks when there's no buffer space available.
+		Close() error
+	}
+}
+
+// ScreenGiveAllClientCall represents the call returned from Screen.GiveAll.
+type ScreenGiveAllClientCall interface {
+	ScreenGiveAllClientStream
+	// Finish performs the equivalent of SendStream().Close, then blocks until
+	// the server is done, and returns the positional return values for the call.
+	//
+	// Finish returns immediately if the call has been canceled; depending on the
+	// timing the output could either be an error signaling cancelation, or the
+	// valid positional return values from the server.
+	//
+	// Calling Finish is mandatory for releasing stream resources, unless the call
+	// has been canceled or any of the other methods return an error.  Finish should
+	// be called at most once.
+	Finish() error
+}
+
+type implScreenGiveAllClientCall struct {
+	rpc.ClientCall
+	valRecv int32
+	errRecv error
+}
+
+func (c *implScreenGiveAllClientCall) RecvStream() interface {
+	Advance() bool
+	Value() int32
+	Err() error
+} {
+	return implScreenGiveAllClientCallRecv{c}
+}
+
+type implScreenGiveAllClientCallRecv struct {
+	c *implScreenGiveAllClientCall
+}
+
+func (c implScreenGiveAllClientCallRecv) Advance() bool {
+	c.c.errRecv = c.c.Recv(&c.c.valRecv)
+	return c.c.errRecv == nil
+}
+func (c implScreenGiveAllClientCallRecv) Value() int32 {
+	return c.c.valRecv
+}
+func (c implScreenGiveAllClientCallRecv) Err() error {
+	if c.c.errRecv == io.EOF {
+		return nil
+	}
+	return c.c.errRecv
+}
+func (c *implScreenGiveAllClientCall) SendStream() interface {
+	Send(item []Triangle) error
+	Close() error
+} {
+	return implScreenGiveAllClientCallSend{c}
+}
+
+type implScreenGiveAllClientCallSend struct {
+	c *implScreenGiveAllClientCall
+}
+
+func (c implScreenGiveAllClientCallSend) Send(item []Triangle) error {
+	return c.c.Send(item)
+}
+func (c implScreenGiveAllClientCallSend) Close() error {
+	return c.c.CloseSend()
+}
+func (c *implScreenGiveAllClientCall) Finish() (err error) {
+	err = c.ClientCall.Finish()
+	return
+}
+
 // ScreenServerMethods is the interface a server writer
 // implements for Screen.
 //
 // Screen represents a remote screen that can be invited to grab triangles.
 type ScreenServerMethods interface {
 	// Invite is a request to the receiver to join the set of screens that
-	// the caller is participating in, by standing to the right of the
-	// caller.
+	// the caller is participating in, by standing in the provided
+	// direction of the caller. For example, if direction is Right, then
+	// the receiver is to the right of the caller (and the caller is to
+	// the left of the receiver).
+	//
+	// The caller provides its Geometry and the receiver returns its own.
 	//
-	// A Screen can be active on at most one invitation at a time and
-	// should return an error if it is engaged in a previous invitation.
-	Invite(*context.T, rpc.ServerCall) error
+	// row identifies the row of screens that the caller belongs to (see
+	// JoinRow), so that the receiver can refuse to join a row that it
+	// already belongs to.
+	//
+	// A Screen can have at most one neighbour in each direction and
+	// should return an error if it already has one where the caller would
+	// stand.
+	Invite(_ *context.T, _ rpc.ServerCall, direction Direction, inviter Geometry, row string) (Geometry, error)
 	// Give is a request by the caller for the receiver to take ownership
 	// of the provided triangle.
 	//
@@ -107,13 +440,79 @@ type ScreenServerMethods interface {
 	// a requirement and Give can be invoked by an arbitrary client to
 	// manufacture a new triangle.
 	Give(_ *context.T, _ rpc.ServerCall, t Triangle) error
+	// GiveAll is a request by the caller for the receiver to take ownership
+	// of the batches of triangles sent on the stream, in the same way as
+	// Give.
+	//
+	// The receiver acknowledges every batch, once it has taken ownership of
+	// all the triangles in it, by sending the number of triangles in the
+	// batch. Callers limit the number of batches sent but not yet
+	// acknowledged, so that a slow receiver pushes back on the caller.
+	GiveAll(*context.T, ScreenGiveAllServerCall) error
+	// Align informs the receiver of the position of a marker that the user
+	// lined up with a marker on the receiver, along the edge that the
+	// caller shares with the receiver. side is the position of the caller
+	// relative to the receiver and marker is in the caller's coordinates
+	// (Y for screens on the left or right, X for screens above or below).
+	// The receiver uses it to place triangles given to it at the same height
+	// (or horizontal position) at which they left the caller, even if the
+	// two screens are not aligned. geometry is that of the caller, which
+	// calls Align again whenever its size changes.
+	Align(_ *context.T, _ rpc.ServerCall, side Direction, marker float32, geometry Geometry) error
+	// JoinRow informs the receiver, which stands on the right of the
+	// caller, that the row of screens linked from left to right that they
+	// both belong to is now identified by head, the leftmost screen in it.
+	// Every screen passes it on to the screen on its right whenever the
+	// row it belongs to changes.
+	JoinRow(_ *context.T, _ rpc.ServerCall, head string) error
 }
 
 // ScreenServerStubMethods is the server interface containing
 // Screen methods, as expected by rpc.Server.
-// There is no difference between this interface and ScreenServerMethods
-// since there are no streaming methods.
-type ScreenServerStubMethods ScreenServerMethods
+// The only difference between this interface and ScreenServerMethods
+// is the streaming methods.
+type ScreenServerStubMethods interface {
+	// Invite is a request to the receiver to join the set of screens that
+	// the caller is participating in, by standing in the provided
+	// direction of the caller. For example, if direction is Right, then
+	// the receiver is to the right of the caller (and the caller is to
+	// the left of the receiver).
+	//
+	// The caller provides its Geometry and the receiver returns its own.
+	//
+	// row identifies the row of screens that the caller belongs to (see
+	// JoinRow), so that the receiver can refuse to join a row that it
+	// already belongs to.
+	//
+	// A Screen can have at most one neighbour in each direction and
+	// should return an error if it already has one where the caller would
+	// stand.
+	Invite(_ *context.T, _ rpc.ServerCall, direction Direction, inviter Geometry, row string) (Geometry, error)
+	// Give is a request by the caller for the receiver to take ownership
+	// of the provided triangle.
+	//
+	// Give is typically invoked on the receiver by the adjacent screen
+	// when a triangle falls off that adjacent screen. However, this is not
+	// a requirement and Give can be invoked by an arbitrary client to
+	// manufacture a new triangle.
+	Give(_ *context.T, _ rpc.ServerCall, t Triangle) error
+	// Align informs the receiver of the position of a marker that the user
+	// lined up with a marker on the receiver, along the edge that the
+	// caller shares with the receiver. side is the position of the caller
+	// relative to the receiver and marker is in the caller's coordinates
+	// (Y for screens on the left or right, X for screens above or below).
+	// The receiver uses it to place triangles given to it at the same height
+	// (or horizontal position) at which they left the caller, even if the
+	// two screens are not aligned. geometry is that of the caller, which
+	// calls Align again whenever its size changes.
+	Align(_ *context.T, _ rpc.ServerCall, side Direction, marker float32, geometry Geometry) error
+	// JoinRow informs the receiver, which stands on the right of the
+	// caller, that the row of screens linked from left to right that they
+	// both belong to is now identified by head, the leftmost screen in it.
+	// Every screen passes it on to the screen on its right whenever the
+	// row it belongs to changes.
+	JoinRow(_ *context.T, _ rpc.ServerCall, head string) error
+}
 
 // ScreenServerStub adds universal methods to ScreenServerStubMethods.
 type ScreenServerStub interface {
@@ -144,14 +543,26 @@ type implScreenServerStub struct {
 	gs   *rpc.GlobState
 }
 
-func (s implScreenServerStub) Invite(ctx *context.T, call rpc.ServerCall) error {
-	return s.impl.Invite(ctx, call)
+func (s implScreenServerStub) Invite(ctx *context.T, call rpc.ServerCall, i0 Direction, i1 Geometry, i2 string) (Geometry, error) {
+	return s.impl.Invite(ctx, call, i0, i1, i2)
 }
 
 func (s implScreenServerStub) Give(ctx *context.T, call rpc.ServerCall, i0 Triangle) error {
 	return s.impl.Give(ctx, call, i0)
 }
 
+func (s implScreenServerStub) GiveAll(ctx *context.T, call *ScreenGiveAllServerCallStub) error {
+	return s.impl.GiveAll(ctx, call)
+}
+
+func (s implScreenServerStub) Align(ctx *context.T, call rpc.ServerCall, i0 Direction, i1 float32, i2 Geometry) error {
+	return s.impl.Align(ctx, call, i0, i1, i2)
+}
+
+func (s implScreenServerStub) JoinRow(ctx *context.T, call rpc.ServerCall, i0 string) error {
+	return s.impl.JoinRow(ctx, call, i0)
+}
+
 func (s implScreenServerStub) Globber() *rpc.GlobState {
 	return s.gs
 }
@@ -171,7 +582,15 @@ var descScreen = rpc.InterfaceDesc{
 	Methods: []rpc.MethodDesc{
 		{
 			Name: "Invite",
-			Doc:  "// Invite is a request to the receiver to join the set of screens that\n// the caller is participating in, by standing to the right of the\n// caller.\n//\n// A Screen can be active on at most one invitation at a time and\n// should return an error if it is engaged in a previous invitation.",
+			Doc:  "// Invite is a request to the receiver to join the set of screens that\n// the caller is participating in, by standing in the provided\n// direction of the caller. For example, if direction is Right, then\n// the receiver is to the right of the caller (and the caller is to\n// the left of the receiver).\n//\n// The caller provides its Geometry and the receiver returns its own.\n//\n// row identifies the row of screens that the caller belongs to (see\n// JoinRow), so that the receiver can refuse to join a row that it\n// already belongs to.\n//\n// A Screen can have at most one neighbour in each direction and\n// should return an error if it already has one where the caller would\n// stand.",
+			InArgs: []rpc.ArgDesc{
+				{"direction", ``}, // Direction
+				{"inviter", ``},   // Geometry
+				{"row", ``},       // string
+			},
+			OutArgs: []rpc.ArgDesc{
+				{"", ``}, // Geometry
+			},
 		},
 		{
 			Name: "Give",
@@ -180,5 +599,110 @@ var descScreen = rpc.InterfaceDesc{
 				{"t", ``}, // Triangle
 			},
 		},
+		{
+			Name: "GiveAll",
+			Doc:  "// GiveAll is a request by the caller for the receiver to take ownership\n// of the batches of triangles sent on the stream, in the same way as\n// Give.\n//\n// The receiver acknowledges every batch, once it has taken ownership of\n// all the triangles in it, by sending the number of triangles in the\n// batch. Callers limit the number of batches sent but not yet\n// acknowledged, so that a slow receiver pushes back on the caller.",
+		},
+		{
+			Name: "Align",
+			Doc:  "// Align informs the receiver of the position of a marker that the user\n// lined up with a marker on the receiver, along the edge that the\n// caller shares with the receiver. side is the position of the caller\n// relative to the receiver and marker is in the caller's coordinates\n// (Y for screens on the left or right, X for screens above or below).\n// The receiver uses it to place triangles given to it at the same height\n// (or horizontal position) at which they left the caller, even if the\n// two screens are not aligned. geometry is that of the caller, which\n// calls Align again whenever its size changes.",
+			InArgs: []rpc.ArgDesc{
+				{"side", ``},     // Direction
+				{"marker", ``},   // float32
+				{"geometry", ``}, // Geometry
+			},
+		},
+		{
+			Name: "JoinRow",
+			Doc:  "// JoinRow informs the receiver, which stands on the right of the\n// caller, that the row of screens linked from left to right that they\n// both belong to is now identified by head, the leftmost screen in it.\n// Every screen passes it on to the screen on its right whenever the\n// row it belongs to changes.",
+			InArgs: []rpc.ArgDesc{
+				{"head", ``}, // string
+			},
+		},
 	},
 }
+
+// ScreenGiveAllServerStream is the server stream for Screen.GiveAll.
+type ScreenGiveAllServerStream interface {
+	// RecvStream returns the receiver side of the Screen.GiveAll server stream.
+	RecvStream() interface {
+		// Advance stages an item so that it may be retrieved via Value.  Returns
+		// true iff there is an item to retrieve.  Advance must be called before
+		// Value is called.  May block if an item is not available.
+		Advance() bool
+		// Value returns the item that was staged by Advance.  May panic if Advance
+		// returned false or was not called.  Never blocks.
+		Value() []Triangle
+		// Err returns any error encountered by Advance.  Never blocks.
+		Err() error
+	}
+	// SendStream returns the send side of the Screen.GiveAll server stream.
+	SendStream() interface {
+		// Send places the item onto the output stream.  Returns errors encountered
+		// while sending.  Blocks if there is no buffer space; will unblock when
+		// buffer space is available.
+		Send(item int32) error
+	}
+}
+
+// ScreenGiveAllServerCall represents the context passed to Screen.GiveAll.
+type ScreenGiveAllServerCall interface {
+	rpc.ServerCall
+	ScreenGiveAllServerStream
+}
+
+// ScreenGiveAllServerCallStub is a wrapper that converts rpc.StreamServerCall into
+// a typesafe stub that implements ScreenGiveAllServerCall.
+type ScreenGiveAllServerCallStub struct {
+	rpc.StreamServerCall
+	valRecv []Triangle
+	errRecv error
+}
+
+// Init initializes ScreenGiveAllServerCallStub from rpc.StreamServerCall.
+func (s *ScreenGiveAllServerCallStub) Init(call rpc.StreamServerCall) {
+	s.StreamServerCall = call
+}
+
+// RecvStream returns the receiver side of the Screen.GiveAll server stream.
+func (s *ScreenGiveAllServerCallStub) RecvStream() interface {
+	Advance() bool
+	Value() []Triangle
+	Err() error
+} {
+	return implScreenGiveAllServerCallRecv{s}
+}
+
+type implScreenGiveAllServerCallRecv struct {
+	s *ScreenGiveAllServerCallStub
+}
+
+func (s implScreenGiveAllServerCallRecv) Advance() bool {
+	s.s.valRecv = nil
+	s.s.errRecv = s.s.Recv(&s.s.valRecv)
+	return s.s.errRecv == nil
+}
+func (s implScreenGiveAllServerCallRecv) Value() []Triangle {
+	return s.s.valRecv
+}
+func (s implScreenGiveAllServerCallRecv) Err() error {
+	if s.s.errRecv == io.EOF {
+		return nil
+	}
+	return s.s.errRecv
+}
+
+// SendStream returns the send side of the Screen.GiveAll server stream.
+func (s *ScreenGiveAllServerCallStub) SendStream() interface {
+	Send(item int32) error
+} {
+	return implScreenGiveAllServerCallSend{s}
+}
+
+type implScreenGiveAllServerCallSend struct {
+	s *ScreenGiveAllServerCallStub
+}
+
+func (s implScreenGiveAllServerCallSend) Send(item int32) error {
+	return s.s.Send(item)
+}
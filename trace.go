@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/asimshankar/triangles/spec"
+	"log"
+)
+
+var flagTrace = flag.Bool("trace", false, "Log every step of the path of every triangle across screens")
+
+// trace logs an event in the life of t, if --trace is set.
+//
+// All events of a triangle are logged with its Id, so grepping the logs of
+// all screens for it yields the path the triangle took.
+func trace(t *spec.Triangle, format string, args ...interface{}) {
+	if !*flagTrace {
+		return
+	}
+	log.Printf("Triangle %v (origin %v, hop %d): %v", t.Id, t.Origin, t.Hops, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/asimshankar/triangles/spec"
+)
+
+var (
+	flagTransport = flag.String("transport", "v23", "Transport used to find and talk to other screens: one of v23 or tcp")
+
+	// Advertisements of screens are tagged with the name of the Screen
+	// interface, so that they can be told apart from those of other
+	// services.
+	interfaceName = spec.ScreenDesc.PkgPath
+)
+
+// newTransport returns the Transport selected by command-line flags.
+func newTransport() (Transport, error) {
+	switch *flagTransport {
+	case "v23":
+		return newV23Transport(), nil
+	case "tcp":
+		return newTCPTransport(*flagTCPAddr, *flagTCPGroup)
+	}
+	return nil, fmt.Errorf("unknown transport %q", *flagTransport)
+}
+
+// newBridgeTransport returns the Transport selected by command-line flags for
+// the n-th (from 1) screen bridged by serveWeb. Other screens must tell the
+// screens bridged by a process apart, so each gets an identity of its own
+// and, with a fixed --tcp-addr, listens on a port of its own.
+func newBridgeTransport(n int) (Transport, error) {
+	switch *flagTransport {
+	case "v23":
+		return &v23Transport{bridge: fmt.Sprintf("web-%d", n)}, nil
+	case "tcp":
+		addr, err := bridgeAddr(*flagTCPAddr, n)
+		if err != nil {
+			return nil, err
+		}
+		return newTCPTransport(addr, *flagTCPGroup)
+	}
+	return nil, fmt.Errorf("unknown transport %q", *flagTransport)
+}
+
+// Transport is the means by which screens find and talk to each other.
+//
+// networkManager implements the logic of linking screens together on top of
+// a Transport, which implements the discovery of other screens and the
+// requests they make of each other (the methods of spec.Screen).
+type Transport interface {
+	// Start starts delivering the requests made by other screens to h and
+	// returns this screen, as other screens identify it (with no Name).
+	Start(h ScreenHandler) (Peer, error)
+	// Stop stops delivering requests and releases all resources.
+	Stop()
+	// Advertise makes this screen discoverable by Scan on other screens,
+	// along with the provided attributes, until stop is called.
+	Advertise(attributes map[string]string) (stop func(), err error)
+	// Scan writes changes to the set of screens that advertise all of the
+	// provided attributes to the returned channel, until cancel is closed
+	// after which the channel is closed.
+	Scan(attributes map[string]string, cancel <-chan struct{}) (<-chan PeerUpdate, error)
+	// Invite invites the screen at addr to stand in direction of this one
+	// (see spec.Screen.Invite) and returns that screen, along with its
+	// Geometry. The invitation is withdrawn if cancel is closed before the
+	// other screen responds.
+	Invite(addr string, direction spec.Direction, geometry spec.Geometry, row string, cancel <-chan struct{}) (Peer, spec.Geometry, error)
+	// GiveAll opens a stream on which triangles are given to the screen at
+	// addr (see spec.Screen.GiveAll), which is aborted when cancel is
+	// closed.
+	GiveAll(addr string, cancel <-chan struct{}) (GiveStream, error)
+	// Give gives a single triangle to the screen at addr (see
+	// spec.Screen.Give), without opening a stream for it.
+	Give(addr string, t spec.Triangle, cancel <-chan struct{}) error
+	// Align informs the screen at addr of the position of the marker on
+	// this screen and of its Geometry (see spec.Screen.Align).
+	Align(addr string, side spec.Direction, marker float32, geometry spec.Geometry, cancel <-chan struct{}) error
+	// JoinRow informs the screen at addr, which stands on the right of this
+	// one, of the row that it belongs to (see spec.Screen.JoinRow).
+	JoinRow(addr string, head string, cancel <-chan struct{}) error
+}
+
+// ScreenHandler handles the requests made by other screens, as delivered by
+// a Transport.
+type ScreenHandler interface {
+	// Invite handles an invitation from caller to stand in direction of
+	// it, returning the Geometry of this screen if it is accepted.
+	// withdrawn is closed if caller withdraws the invitation.
+	Invite(caller Peer, direction spec.Direction, geometry spec.Geometry, row string, withdrawn <-chan struct{}) (spec.Geometry, error)
+	// Give takes ownership of triangles given by caller, unless caller is
+	// not allowed to give triangles to this screen.
+	Give(caller Peer, triangles []spec.Triangle) error
+	// Align records the position of the marker on caller, which stands on
+	// side of this screen, and the Geometry of caller.
+	Align(caller Peer, side spec.Direction, marker float32, geometry spec.Geometry) error
+	// JoinRow records that the row of screens this one belongs to is now
+	// identified by head.
+	JoinRow(caller Peer, head string) error
+}
+
+// GiveStream is a stream of batches of triangles given to another screen,
+// which acknowledges every batch with the number of triangles in it.
+type GiveStream interface {
+	Send(triangles []spec.Triangle) error
+	// Recv returns the next acknowledgement, or io.EOF if the other
+	// screen closed the stream. It returns an error once the stream is
+	// aborted.
+	Recv() (int32, error)
+	// Finish indicates that no more triangles will be sent and waits for
+	// the other screen to close the stream.
+	Finish() error
+}
+
+// Peer identifies another screen making a request, or accepting one.
+type Peer struct {
+	Name  string // Address at which the Transport can reach the screen
+	Color Color  // Identifies the screen to the user
+	// Id identifies the screen to other screens, by its credentials where
+	// the Transport has any. Unlike Name, it is the same whether the
+	// screen made a request or was reached at an address.
+	Id string
+	// Trusted is true if the screen may give triangles to this one without
+	// being linked with it.
+	Trusted bool
+}
+
+// PeerUpdate is a change to the set of screens found by Transport.Scan.
+type PeerUpdate struct {
+	Id         string            // Identifies the screen across updates
+	Addresses  []string          // Equivalent addresses at which the Transport can reach the screen
+	Attributes map[string]string // Advertised by the screen
+	Lost       bool              // True if the screen is no longer advertised
+}
+
+// matchAttributes returns true if attributes include all the wanted ones.
+func matchAttributes(attributes, want map[string]string) bool {
+	for k, v := range want {
+		if attributes[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"github.com/asimshankar/triangles/spec"
+	"io"
+	"sync"
+)
+
+// memNetwork connects the Transports it creates to each other over Go
+// channels, for running several screens in a single process without any
+// networking.
+type memNetwork struct {
+	mu       sync.Mutex
+	screens  map[string]ScreenHandler // Started transports, by name
+	ads      map[string]memAd         // Active advertisements, by id
+	scanners map[*memScanner]bool
+	next     int // Used to generate names and ids
+}
+
+type memAd struct {
+	name       string
+	attributes map[string]string
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		screens:  make(map[string]ScreenHandler),
+		ads:      make(map[string]memAd),
+		scanners: make(map[*memScanner]bool),
+	}
+}
+
+// NewTransport returns a Transport for a new screen on n.
+func (n *memNetwork) NewTransport() Transport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.next++
+	name := fmt.Sprintf("mem/%d", n.next)
+	return &memTransport{net: n, name: name, color: selectColor([]byte(name))}
+}
+
+// handler returns the ScreenHandler of the screen named addr.
+func (n *memNetwork) handler(addr string) (ScreenHandler, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if h, ok := n.screens[addr]; ok {
+		return h, nil
+	}
+	return nil, fmt.Errorf("no screen at %q", addr)
+}
+
+type memTransport struct {
+	net   *memNetwork
+	name  string
+	color Color
+}
+
+func (t *memTransport) Start(h ScreenHandler) (Peer, error) {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	t.net.screens[t.name] = h
+	return Peer{Color: t.color, Id: t.name}, nil
+}
+
+func (t *memTransport) Stop() {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+	delete(t.net.screens, t.name)
+}
+
+func (t *memTransport) Advertise(attributes map[string]string) (func(), error) {
+	n := t.net
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.next++
+	id := fmt.Sprintf("mem-ad/%d", n.next)
+	n.ads[id] = memAd{name: t.name, attributes: attributes}
+	for s := range n.scanners {
+		s.found(id, n.ads[id])
+	}
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		ad, ok := n.ads[id]
+		if !ok {
+			return
+		}
+		delete(n.ads, id)
+		for s := range n.scanners {
+			if s.matches(ad) {
+				s.push(PeerUpdate{Id: id, Addresses: []string{ad.name}, Attributes: ad.attributes, Lost: true})
+			}
+		}
+	}, nil
+}
+
+func (t *memTransport) Scan(attributes map[string]string, cancel <-chan struct{}) (<-chan PeerUpdate, error) {
+	var (
+		n   = t.net
+		s   = &memScanner{self: t.name, attributes: attributes, wake: make(chan struct{}, 1)}
+		ret = make(chan PeerUpdate)
+	)
+	n.mu.Lock()
+	n.scanners[s] = true
+	for id, ad := range n.ads {
+		s.found(id, ad)
+	}
+	n.mu.Unlock()
+	go func() {
+		s.run(ret, cancel)
+		n.mu.Lock()
+		delete(n.scanners, s)
+		n.mu.Unlock()
+	}()
+	return ret, nil
+}
+
+func (t *memTransport) Invite(addr string, direction spec.Direction, geometry spec.Geometry, row string, cancel <-chan struct{}) (Peer, spec.Geometry, error) {
+	h, err := t.net.handler(addr)
+	if err != nil {
+		return Peer{}, spec.Geometry{}, err
+	}
+	g, err := h.Invite(t.peer(), direction, geometry, row, cancel)
+	if err != nil {
+		return Peer{}, spec.Geometry{}, err
+	}
+	return Peer{Name: addr, Color: selectColor([]byte(addr)), Id: addr}, g, nil
+}
+
+func (t *memTransport) GiveAll(addr string, cancel <-chan struct{}) (GiveStream, error) {
+	if _, err := t.net.handler(addr); err != nil {
+		return nil, err
+	}
+	s := &memGiveStream{
+		batches: make(chan []spec.Triangle),
+		acks:    make(chan int32),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+	go func() {
+		defer close(s.done)
+		for {
+			var batch []spec.Triangle
+			select {
+			case b, ok := <-s.batches:
+				if !ok {
+					return
+				}
+				batch = b
+			case <-cancel:
+				return
+			}
+			// Look up the screen for every batch, so that the stream
+			// breaks if the screen stops.
+			h, err := t.net.handler(addr)
+			if err != nil {
+				return
+			}
+			if err := h.Give(t.peer(), batch); err != nil {
+				s.err = err
+				return
+			}
+			select {
+			case s.acks <- int32(len(batch)):
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (t *memTransport) Give(addr string, tri spec.Triangle, cancel <-chan struct{}) error {
+	h, err := t.net.handler(addr)
+	if err != nil {
+		return err
+	}
+	return h.Give(t.peer(), []spec.Triangle{tri})
+}
+
+func (t *memTransport) Align(addr string, side spec.Direction, marker float32, geometry spec.Geometry, cancel <-chan struct{}) error {
+	h, err := t.net.handler(addr)
+	if err != nil {
+		return err
+	}
+	return h.Align(t.peer(), side, marker, geometry)
+}
+
+func (t *memTransport) JoinRow(addr string, head string, cancel <-chan struct{}) error {
+	h, err := t.net.handler(addr)
+	if err != nil {
+		return err
+	}
+	return h.JoinRow(t.peer(), head)
+}
+
+func (t *memTransport) peer() Peer { return Peer{Name: t.name, Color: t.color, Id: t.name} }
+
+// memGiveStream is a GiveStream between two memTransports.
+type memGiveStream struct {
+	batches chan []spec.Triangle
+	acks    chan int32
+	done    chan struct{} // Closed when the receiving screen stops reading batches
+	err     error         // Set before done is closed, if the receiving screen refused a batch
+	cancel  <-chan struct{}
+}
+
+func (s *memGiveStream) Send(triangles []spec.Triangle) error {
+	// Copy the triangles, as they would be if they were sent over the network.
+	batch := append([]spec.Triangle(nil), triangles...)
+	select {
+	case s.batches <- batch:
+		return nil
+	case <-s.done:
+		return io.ErrClosedPipe
+	case <-s.cancel:
+		return errMemCanceled
+	}
+}
+
+func (s *memGiveStream) Recv() (int32, error) {
+	select {
+	case n := <-s.acks:
+		return n, nil
+	case <-s.done:
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	case <-s.cancel:
+		return 0, errMemCanceled
+	}
+}
+
+func (s *memGiveStream) Finish() error {
+	close(s.batches)
+	select {
+	case <-s.done:
+		return s.err
+	case <-s.cancel:
+		return errMemCanceled
+	}
+}
+
+// memScanner delivers the updates for a memTransport.Scan in order, without
+// blocking the memNetwork.
+type memScanner struct {
+	self       string // Name of the scanning screen, whose advertisements are ignored
+	attributes map[string]string
+	mu         sync.Mutex
+	queue      []PeerUpdate
+	wake       chan struct{} // Signalled when queue becomes non-empty
+}
+
+func (s *memScanner) matches(ad memAd) bool {
+	return ad.name != s.self && matchAttributes(ad.attributes, s.attributes)
+}
+
+func (s *memScanner) found(id string, ad memAd) {
+	if s.matches(ad) {
+		s.push(PeerUpdate{Id: id, Addresses: []string{ad.name}, Attributes: ad.attributes})
+	}
+}
+
+func (s *memScanner) push(u PeerUpdate) {
+	s.mu.Lock()
+	s.queue = append(s.queue, u)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run writes queued updates to out until cancel is closed.
+func (s *memScanner) run(out chan<- PeerUpdate, cancel <-chan struct{}) {
+	defer close(out)
+	for {
+		select {
+		case <-s.wake:
+		case <-cancel:
+			return
+		}
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, u := range queue {
+			select {
+			case out <- u:
+			case <-cancel:
+				return
+			}
+		}
+	}
+}
+
+var errMemCanceled = fmt.Errorf("canceled")
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/asimshankar/triangles/spec"
+	"github.com/pborman/uuid"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	flagTCPAddr  = flag.String("tcp-addr", ":0", "Address on which other screens connect to this one (only with --transport=tcp)")
+	flagTCPGroup = flag.String("tcp-group", "239.255.23.23:2323", "UDP multicast address on which screens are advertised and scanned for (only with --transport=tcp)")
+)
+
+// tcpTransport is a Transport that needs no infrastructure beyond the local
+// network: screens are advertised by periodically announcing them to a UDP
+// multicast group, and requests are made over TCP connections.
+//
+// Each request is made on a new connection, on which both sides write
+// tcpMessages, each prefixed by its length as a 4-byte big-endian integer.
+//
+// An Invite request is answered with the Geometry and the identifier of the
+// screen or an Error, and the caller withdraws the invitation by closing the
+// connection. A GiveAll request is followed by a message per batch of
+// triangles, each answered with the number of triangles in it (or an Error,
+// which ends the stream), until the caller closes its side of the connection.
+// Give, Align and JoinRow requests are answered with an empty message or an
+// Error.
+//
+// Every screen identifies itself by the public half of a key that it generates
+// when it starts, and proves that it holds the private half on every
+// connection: the screen accepting the connection first writes a nonce, which
+// the caller signs in its request, and the invited screen signs a nonce sent
+// by the caller in its response to an Invite request. Thus other screens
+// cannot pose as a screen by sending its identifier (see Peer.Id), though
+// nothing is encrypted.
+type tcpTransport struct {
+	id       string // Unique identifier of this screen, the hex-encoded public half of key
+	key      *ecdsa.PrivateKey
+	addr     string
+	group    *net.UDPAddr
+	listener net.Listener
+	stopped  chan struct{} // Closed by Stop
+	once     sync.Once
+}
+
+func newTCPTransport(addr, group string) (*tcpTransport, error) {
+	g, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !g.IP.IsMulticast() {
+		return nil, fmt.Errorf("%v is not a multicast address", group)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpTransport{
+		id:      hex.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y)),
+		key:     key,
+		addr:    addr,
+		group:   g,
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// bridgeAddr returns the address on which the n-th screen bridged by serveWeb
+// listens: addr if the system picks its port, addr with its port n higher
+// otherwise.
+func bridgeAddr(addr string, n int) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in %q: %v", addr, err)
+	}
+	if p == 0 {
+		return addr, nil
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+n)), nil
+}
+
+func (t *tcpTransport) Start(h ScreenHandler) (Peer, error) {
+	l, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return Peer{}, err
+	}
+	t.listener = l
+	log.Printf("Accepting connections from other screens on %v", l.Addr())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-t.stopped:
+				default:
+					log.Printf("Stopped accepting connections: %v", err)
+				}
+				return
+			}
+			go t.serve(h, conn)
+		}
+	}()
+	return Peer{Color: selectColor([]byte(t.id)), Id: t.id}, nil
+}
+
+func (t *tcpTransport) Stop() {
+	t.once.Do(func() {
+		close(t.stopped)
+		if t.listener != nil {
+			t.listener.Close()
+		}
+	})
+}
+
+func (t *tcpTransport) port() int { return t.listener.Addr().(*net.TCPAddr).Port }
+
+func (t *tcpTransport) Advertise(attributes map[string]string) (func(), error) {
+	conn, err := net.DialUDP("udp4", nil, t.group)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ad = tcpAnnouncement{
+			Interface:  interfaceName,
+			Screen:     t.id,
+			Id:         uuid.New(),
+			Port:       t.port(),
+			Attributes: attributes,
+		}
+		stop    = make(chan struct{})
+		stopped = make(chan struct{})
+		send    = func() {
+			buf, err := json.Marshal(ad)
+			if err == nil {
+				_, err = conn.Write(buf)
+			}
+			if err != nil {
+				log.Printf("Failed to announce %v: %v", ad.Id, err)
+			}
+		}
+	)
+	go func() {
+		defer close(stopped)
+		defer conn.Close()
+		ticker := time.NewTicker(tcpAnnounceInterval)
+		defer ticker.Stop()
+		for {
+			send()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				ad.Lost = true
+				send()
+				return
+			case <-t.stopped:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}, nil
+}
+
+func (t *tcpTransport) Scan(attributes map[string]string, cancel <-chan struct{}) (<-chan PeerUpdate, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, t.group)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(chan PeerUpdate)
+	go func() {
+		select {
+		case <-cancel:
+		case <-t.stopped:
+		}
+		conn.Close()
+	}()
+	go func() {
+		defer close(ret)
+		var (
+			found    = make(map[string]PeerUpdate) // Advertisements found and not yet lost, by id
+			lastSeen = make(map[string]time.Time)
+			buf      = make([]byte, maxTCPAnnouncementSize)
+		)
+		for {
+			var updates []PeerUpdate
+			conn.SetReadDeadline(time.Now().Add(tcpAnnounceInterval))
+			n, src, err := conn.ReadFromUDP(buf)
+			if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Timeout()) {
+				return
+			}
+			var ad tcpAnnouncement
+			if err == nil && json.Unmarshal(buf[:n], &ad) == nil && ad.Interface == interfaceName && ad.Screen != t.id && matchAttributes(ad.Attributes, attributes) {
+				u, ok := found[ad.Id]
+				switch {
+				case ad.Lost && ok:
+					delete(found, ad.Id)
+					delete(lastSeen, ad.Id)
+					u.Lost = true
+					updates = append(updates, u)
+				case !ad.Lost && !ok:
+					u = PeerUpdate{
+						Id:         ad.Id,
+						Addresses:  []string{net.JoinHostPort(src.IP.String(), strconv.Itoa(ad.Port))},
+						Attributes: ad.Attributes,
+					}
+					found[ad.Id] = u
+					updates = append(updates, u)
+					fallthrough
+				case !ad.Lost:
+					lastSeen[ad.Id] = time.Now()
+				}
+			}
+			// Consider advertisements that have not been announced
+			// in a while to be lost, as the announcement that they
+			// stopped may have never arrived.
+			for id, seen := range lastSeen {
+				if time.Since(seen) > tcpAdvertisementTimeout {
+					u := found[id]
+					delete(found, id)
+					delete(lastSeen, id)
+					u.Lost = true
+					updates = append(updates, u)
+				}
+			}
+			for _, u := range updates {
+				select {
+				case ret <- u:
+				case <-cancel:
+					return
+				}
+			}
+		}
+	}()
+	return ret, nil
+}
+
+func (t *tcpTransport) Invite(addr string, direction spec.Direction, geometry spec.Geometry, row string, cancel <-chan struct{}) (Peer, spec.Geometry, error) {
+	req := &tcpMessage{Method: "Invite", Direction: direction, Geometry: geometry, Row: row}
+	resp, err := t.call(addr, req, cancel)
+	if err != nil {
+		return Peer{}, spec.Geometry{}, err
+	}
+	if err := verifyTCP(resp.Caller, tcpCalleeRole, req.Nonce, req.Method, resp.Signature); err != nil {
+		return Peer{}, spec.Geometry{}, fmt.Errorf("%v did not prove its identity: %v", addr, err)
+	}
+	return Peer{Name: addr, Color: selectColor([]byte(resp.Caller)), Id: resp.Caller}, resp.Geometry, nil
+}
+
+func (t *tcpTransport) GiveAll(addr string, cancel <-chan struct{}) (GiveStream, error) {
+	conn, err := t.dial(addr, &tcpMessage{Method: "GiveAll"}, cancel)
+	if err != nil {
+		return nil, err
+	}
+	s := &tcpGiveStream{
+		conn:   conn,
+		acks:   make(chan int32),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	go func() {
+		defer close(s.done)
+		for {
+			m, err := readTCPMessage(conn)
+			if err != nil {
+				if err != io.EOF {
+					s.err = err
+				}
+				return
+			}
+			if len(m.Error) > 0 {
+				s.err = errors.New(m.Error)
+				return
+			}
+			select {
+			case s.acks <- m.Count:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-cancel:
+		case <-s.done:
+		}
+		conn.Close()
+	}()
+	return s, nil
+}
+
+func (t *tcpTransport) Give(addr string, tri spec.Triangle, cancel <-chan struct{}) error {
+	_, err := t.call(addr, &tcpMessage{Method: "Give", Triangles: []spec.Triangle{tri}}, cancel)
+	return err
+}
+
+func (t *tcpTransport) Align(addr string, side spec.Direction, marker float32, geometry spec.Geometry, cancel <-chan struct{}) error {
+	_, err := t.call(addr, &tcpMessage{Method: "Align", Direction: side, Marker: marker, Geometry: geometry}, cancel)
+	return err
+}
+
+func (t *tcpTransport) JoinRow(addr string, head string, cancel <-chan struct{}) error {
+	_, err := t.call(addr, &tcpMessage{Method: "JoinRow", Row: head}, cancel)
+	return err
+}
+
+// dial connects to the screen at addr and writes the request req to it,
+// signing the nonce that the screen writes first. The connection is closed if
+// cancel is closed before that.
+func (t *tcpTransport) dial(addr string, req *tcpMessage, cancel <-chan struct{}) (*net.TCPConn, error) {
+	dialer := net.Dialer{Cancel: cancel}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-cancel:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	challenge, err := readTCPMessage(conn)
+	if err == nil {
+		req.Caller, req.Port = t.id, t.port()
+		if req.Nonce, err = newTCPNonce(); err == nil {
+			req.Signature, err = t.sign(tcpCallerRole, challenge.Nonce, req.Method)
+		}
+	}
+	if err == nil {
+		err = writeTCPMessage(conn, req)
+	}
+	if err != nil {
+		conn.Close()
+		select {
+		case <-cancel:
+			return nil, errTCPCanceled
+		default:
+			return nil, err
+		}
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// call makes the request req of the screen at addr and returns its response,
+// giving up when cancel is closed.
+func (t *tcpTransport) call(addr string, req *tcpMessage, cancel <-chan struct{}) (*tcpMessage, error) {
+	conn, err := t.dial(addr, req, cancel)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-cancel:
+		case <-done:
+		}
+		conn.Close()
+	}()
+	resp, err := readTCPMessage(conn)
+	if err != nil {
+		select {
+		case <-cancel:
+			return nil, errTCPCanceled
+		default:
+			return nil, err
+		}
+	}
+	if len(resp.Error) > 0 {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// serve delivers the request made on conn to h, once the caller proved that
+// it is the screen it claims to be.
+func (t *tcpTransport) serve(h ScreenHandler, conn net.Conn) {
+	defer conn.Close()
+	nonce, err := newTCPNonce()
+	if err != nil {
+		log.Printf("Failed to challenge %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if err := writeTCPMessage(conn, &tcpMessage{Nonce: nonce}); err != nil {
+		return
+	}
+	req, err := readTCPMessage(conn)
+	if err != nil {
+		log.Printf("Failed to read request from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if err := verifyTCP(req.Caller, tcpCallerRole, nonce, req.Method, req.Signature); err != nil {
+		log.Printf("Rejected request from %v, which did not prove its identity: %v", conn.RemoteAddr(), err)
+		writeTCPMessage(conn, &tcpMessage{Error: "caller did not prove its identity"})
+		return
+	}
+	var (
+		host, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+		peer       = Peer{
+			Name:  net.JoinHostPort(host, strconv.Itoa(req.Port)),
+			Color: selectColor([]byte(req.Caller)),
+			Id:    req.Caller,
+		}
+		resp tcpMessage
+	)
+	switch req.Method {
+	case "Invite":
+		// The caller closes the connection to withdraw the invitation.
+		withdrawn := make(chan struct{})
+		go func() {
+			readTCPMessage(conn)
+			close(withdrawn)
+		}()
+		resp.Geometry, err = h.Invite(peer, req.Direction, req.Geometry, req.Row, withdrawn)
+		resp.Caller = t.id
+		var signErr error
+		if resp.Signature, signErr = t.sign(tcpCalleeRole, req.Nonce, req.Method); signErr != nil {
+			log.Printf("Failed to respond to %v: %v", peer.Name, signErr)
+			return
+		}
+	case "GiveAll":
+		for {
+			m, err := readTCPMessage(conn)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				log.Printf("GiveAll from %v failed: %v", peer.Name, err)
+				return
+			}
+			if err := h.Give(peer, m.Triangles); err != nil {
+				log.Printf("Rejected triangles from %v: %v", peer.Name, err)
+				writeTCPMessage(conn, &tcpMessage{Error: err.Error()})
+				return
+			}
+			if err := writeTCPMessage(conn, &tcpMessage{Count: int32(len(m.Triangles))}); err != nil {
+				return
+			}
+		}
+	case "Give":
+		if err = h.Give(peer, req.Triangles); err != nil {
+			log.Printf("Rejected triangles from %v: %v", peer.Name, err)
+		}
+	case "Align":
+		err = h.Align(peer, req.Direction, req.Marker, req.Geometry)
+	case "JoinRow":
+		err = h.JoinRow(peer, req.Row)
+	default:
+		err = fmt.Errorf("unknown method %q", req.Method)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeTCPMessage(conn, &resp)
+}
+
+// tcpGiveStream is a GiveStream over the connection of a GiveAll request.
+type tcpGiveStream struct {
+	conn   *net.TCPConn
+	acks   chan int32
+	done   chan struct{} // Closed when the screen closes its side of the connection
+	err    error         // Set before done is closed, if the connection failed
+	cancel <-chan struct{}
+}
+
+func (s *tcpGiveStream) Send(triangles []spec.Triangle) error {
+	return writeTCPMessage(s.conn, &tcpMessage{Triangles: triangles})
+}
+
+func (s *tcpGiveStream) Recv() (int32, error) {
+	select {
+	case n := <-s.acks:
+		return n, nil
+	case <-s.done:
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	case <-s.cancel:
+		return 0, errTCPCanceled
+	}
+}
+
+func (s *tcpGiveStream) Finish() error {
+	if err := s.conn.CloseWrite(); err != nil {
+		return err
+	}
+	select {
+	case <-s.done:
+		return s.err
+	case <-s.cancel:
+		return errTCPCanceled
+	}
+}
+
+// tcpMessage is the unit of communication between tcpTransports. Only the
+// fields relevant to each message are set.
+type tcpMessage struct {
+	// Requests
+	Method string `json:",omitempty"` // Invite, GiveAll, Give, Align or JoinRow
+	Caller string `json:",omitempty"` // Unique identifier of the calling screen, or of the invited one in a response
+	Port   int    `json:",omitempty"` // On which the calling screen accepts connections
+
+	// Proof of the identity of Caller, see tcpTransport
+	Nonce     []byte `json:",omitempty"` // To be signed by the other screen
+	Signature []byte `json:",omitempty"` // Of the nonce of the other screen
+
+	// Arguments and results
+	Direction spec.Direction `json:",omitempty"`
+	Geometry  spec.Geometry
+	Marker    float32         `json:",omitempty"`
+	Row       string          `json:",omitempty"` // Of the inviter, or the head of the row in JoinRow
+	Triangles []spec.Triangle `json:",omitempty"`
+	Count     int32           `json:",omitempty"`
+	Error     string          `json:",omitempty"`
+}
+
+func writeTCPMessage(w io.Writer, m *tcpMessage) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	_, err = w.Write(append(buf, body...))
+	return err
+}
+
+// readTCPMessage reads the next message from r, returning io.EOF if r was
+// closed before it.
+func readTCPMessage(r io.Reader) (*tcpMessage, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxTCPMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", n, maxTCPMessageSize)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var m tcpMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// tcpAnnouncement is periodically sent to the multicast group by a
+// tcpTransport for each of its advertisements.
+type tcpAnnouncement struct {
+	Interface  string // Always interfaceName, to ignore other traffic on the group
+	Screen     string // Unique identifier of the advertised screen
+	Id         string // Of the advertisement
+	Port       int    // On which the screen accepts connections
+	Attributes map[string]string
+	Lost       bool // Sent once when the advertisement stops
+}
+
+var errTCPCanceled = errors.New("canceled")
+
+// Roles in which screens sign nonces, so that a signature made in one role
+// cannot be used to pose as the screen in the other.
+const (
+	tcpCallerRole = "triangles/tcp caller"
+	tcpCalleeRole = "triangles/tcp callee"
+)
+
+func newTCPNonce() ([]byte, error) {
+	nonce := make([]byte, tcpNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// tcpSignature is the ASN.1 encoding of an ECDSA signature.
+type tcpSignature struct {
+	R, S *big.Int
+}
+
+// tcpDigest returns the digest that a screen signs in role, for the nonce of
+// the other screen and a request for method.
+func tcpDigest(role string, nonce []byte, method string) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", role, method)
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+func (t *tcpTransport) sign(role string, nonce []byte, method string) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, tcpDigest(role, nonce, method))
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(tcpSignature{r, s})
+}
+
+// verifyTCP returns nil if signature was made by the screen identified by id,
+// in role, for nonce and a request for method.
+func verifyTCP(id, role string, nonce []byte, method string, signature []byte) error {
+	if len(nonce) != tcpNonceSize {
+		return fmt.Errorf("invalid nonce")
+	}
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return fmt.Errorf("invalid identifier: %v", err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), b)
+	if x == nil {
+		return fmt.Errorf("invalid identifier")
+	}
+	var sig tcpSignature
+	if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) > 0 {
+		return fmt.Errorf("invalid signature")
+	}
+	if !ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, tcpDigest(role, nonce, method), sig.R, sig.S) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+const (
+	tcpAnnounceInterval     = time.Second
+	tcpAdvertisementTimeout = 3 * tcpAnnounceInterval
+	maxTCPAnnouncementSize  = 4096
+	maxTCPMessageSize       = 1 << 20
+	tcpNonceSize            = 16
+)
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/asimshankar/triangles/spec"
+	"net"
+	"testing"
+)
+
+// alignHandler is a ScreenHandler that records the callers of Align.
+type alignHandler struct {
+	callers chan Peer
+}
+
+func (h alignHandler) Invite(Peer, spec.Direction, spec.Geometry, string, <-chan struct{}) (spec.Geometry, error) {
+	return spec.Geometry{}, nil
+}
+func (h alignHandler) Give(Peer, []spec.Triangle) error { return nil }
+func (h alignHandler) Align(caller Peer, side spec.Direction, marker float32, geometry spec.Geometry) error {
+	h.callers <- caller
+	return nil
+}
+func (h alignHandler) JoinRow(Peer, string) error { return nil }
+
+// TestTCPSpoofedCaller checks that a screen cannot make requests on behalf of
+// another one by sending its identifier.
+func TestTCPSpoofedCaller(t *testing.T) {
+	var transports [3]*tcpTransport
+	for i := range transports {
+		var err error
+		if transports[i], err = newTCPTransport("127.0.0.1:0", "239.255.23.23:2323"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server, victim, attacker := transports[0], transports[1], transports[2]
+	h := alignHandler{make(chan Peer, 1)}
+	if _, err := server.Start(h); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	for _, tr := range []*tcpTransport{victim, attacker} {
+		if _, err := tr.Start(h); err != nil {
+			t.Fatal(err)
+		}
+		defer tr.Stop()
+	}
+	addr := server.listener.Addr().String()
+
+	if err := attacker.Align(addr, spec.DirectionLeft, 0, spec.Geometry{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-h.callers; got.Id != attacker.id {
+		t.Errorf("Got caller %v, want %v", got.Id, attacker.id)
+	}
+
+	// Sign the nonce as the attacker, but claim to be the victim.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	challenge, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &tcpMessage{Method: "Align", Direction: spec.DirectionLeft, Caller: victim.id, Port: victim.port()}
+	if req.Signature, err = attacker.sign(tcpCallerRole, challenge.Nonce, req.Method); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTCPMessage(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readTCPMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Error) == 0 {
+		t.Errorf("Request on behalf of %v was not rejected", victim.id)
+	}
+	select {
+	case got := <-h.callers:
+		t.Errorf("Align called by %v", got.Id)
+	default:
+	}
+}
+
+func TestBridgeAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		n    int
+		want string
+	}{
+		{":0", 3, ":0"},
+		{"127.0.0.1:0", 1, "127.0.0.1:0"},
+		{":2323", 1, ":2324"},
+		{"127.0.0.1:2323", 2, "127.0.0.1:2325"},
+		{"[::1]:2323", 1, "[::1]:2324"},
+	}
+	for _, test := range tests {
+		if got, err := bridgeAddr(test.addr, test.n); err != nil || got != test.want {
+			t.Errorf("bridgeAddr(%q, %d) = (%q, %v), want %q", test.addr, test.n, got, err, test.want)
+		}
+	}
+	for _, addr := range []string{"", "2323", "localhost:http"} {
+		if got, err := bridgeAddr(addr, 1); err == nil {
+			t.Errorf("bridgeAddr(%q, 1) = %q, want an error", addr, got)
+		}
+	}
+}
+
+// TestTCPBridges checks that the screens bridged by serveWeb have identities
+// and addresses of their own, even with a fixed --tcp-addr.
+func TestTCPBridges(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	defer func(transport, addr string) { *flagTransport, *flagTCPAddr = transport, addr }(*flagTransport, *flagTCPAddr)
+	*flagTransport, *flagTCPAddr = "tcp", addr
+
+	var (
+		ids   = make(map[string]bool)
+		addrs = make(map[string]bool)
+	)
+	for n := 1; n <= 2; n++ {
+		tr, err := newBridgeTransport(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		me, err := tr.Start(alignHandler{})
+		if err != nil {
+			t.Fatalf("Bridge #%d: %v", n, err)
+		}
+		defer tr.Stop()
+		ids[me.Id] = true
+		addrs[tr.(*tcpTransport).listener.Addr().String()] = true
+	}
+	if len(ids) != 2 || len(addrs) != 2 {
+		t.Errorf("Two bridges have %d identifiers and %d addresses, want 2 of each", len(ids), len(addrs))
+	}
+}
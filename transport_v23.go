@@ -0,0 +1,367 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/asimshankar/triangles/spec"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"v.io/v23"
+	"v.io/v23/context"
+	"v.io/v23/discovery"
+	"v.io/v23/options"
+	"v.io/v23/rpc"
+	"v.io/v23/security"
+	"v.io/v23/security/access"
+	discutil "v.io/x/ref/lib/discovery"
+	vsecurity "v.io/x/ref/lib/security"
+
+	_ "v.io/x/ref/runtime/factories/roaming"
+)
+
+var (
+	flagV23InviteACL = flag.String("v23-invite-acl", "", "Comma-separated blessing patterns of the screens allowed to invite this one, all screens are if empty (only with --transport=v23)")
+	flagV23GiveACL   = flag.String("v23-give-acl", "", "Comma-separated blessing patterns of the screens allowed to give triangles to this one without being linked with it (only with --transport=v23)")
+)
+
+// v23Transport is a Transport that uses the v23 discovery API to find other
+// screens and v23 RPCs to talk to them.
+type v23Transport struct {
+	ctx    *context.T
+	cancel context.CancelFunc
+	server rpc.Server
+	disc   discovery.T
+	bridge string // If set, the blessing extension of the principal of a screen bridged by serveWeb
+}
+
+// The v23 runtime can only be initialized once per process, so it is shared
+// by all v23Transports (e.g., those of the screens bridged by serveWeb, which
+// get principals of their own, see newBridgeTransport).
+var (
+	v23Once sync.Once
+	v23Ctx  *context.T
+)
+
+func newV23Transport() *v23Transport { return &v23Transport{} }
+
+func (t *v23Transport) Start(h ScreenHandler) (Peer, error) {
+	invite, err := parseAccessList(*flagV23InviteACL)
+	if err != nil {
+		return Peer{}, err
+	}
+	give, err := parseAccessList(*flagV23GiveACL)
+	if err != nil {
+		return Peer{}, err
+	}
+	v23Once.Do(func() { v23Ctx, _ = v23.Init() })
+	ctx, cancel := context.WithCancel(v23Ctx)
+	t.cancel = cancel
+	if len(t.bridge) > 0 {
+		if ctx, err = withBridgePrincipal(ctx, t.bridge); err != nil {
+			return Peer{}, err
+		}
+	}
+	ctx, server, err := v23.WithNewServer(ctx, "", spec.ScreenServer(v23Screen{h: h, give: give}), v23Authorizer{invite})
+	if err != nil {
+		return Peer{}, err
+	}
+	disc, err := v23.NewDiscovery(ctx)
+	if err != nil {
+		return Peer{}, err
+	}
+	t.ctx, t.server, t.disc = ctx, server, disc
+	// Select a color based on some unique identifier of the process, the PublicKey serves as one.
+	key := v23.GetPrincipal(ctx).PublicKey()
+	return Peer{Color: publicKeyColor(key), Id: key.String()}, nil
+}
+
+// withBridgePrincipal returns ctx with a new principal, blessed by the
+// principal of the process under extension, since the screens bridged by
+// serveWeb share the v23 runtime but must not share its identity.
+func withBridgePrincipal(ctx *context.T, extension string) (*context.T, error) {
+	p, err := vsecurity.NewPrincipal()
+	if err != nil {
+		return nil, err
+	}
+	parent := v23.GetPrincipal(ctx)
+	blessings, err := parent.Bless(p.PublicKey(), parent.BlessingStore().Default(), extension, security.UnconstrainedUse())
+	if err != nil {
+		return nil, err
+	}
+	if err := vsecurity.SetDefaultBlessings(p, blessings); err != nil {
+		return nil, err
+	}
+	return v23.WithPrincipal(ctx, p)
+}
+
+func (t *v23Transport) Stop() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+func (t *v23Transport) Advertise(attributes map[string]string) (func(), error) {
+	ad := &discovery.Advertisement{
+		InterfaceName: interfaceName,
+		Attributes:    discovery.Attributes(attributes),
+	}
+	ctx, cancel := context.WithCancel(t.ctx)
+	stopped, err := discutil.AdvertiseServer(ctx, t.disc, t.server, "", ad, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return func() {
+		cancel()
+		<-stopped
+	}, nil
+}
+
+func (t *v23Transport) Scan(attributes map[string]string, cancel <-chan struct{}) (<-chan PeerUpdate, error) {
+	ctx, stop := t.withCancel(cancel)
+	updates, err := t.disc.Scan(ctx, scanQuery(attributes))
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	ret := make(chan PeerUpdate)
+	go func() {
+		defer close(ret)
+		defer stop()
+		for u := range updates {
+			pu := PeerUpdate{
+				Id:         u.Id().String(),
+				Addresses:  u.Addresses(),
+				Attributes: u.Advertisement().Attributes,
+				Lost:       u.IsLost(),
+			}
+			select {
+			case ret <- pu:
+			case <-cancel:
+				// updates will be closed soon since ctx has been canceled.
+				for range updates {
+				}
+				return
+			}
+		}
+	}()
+	return ret, nil
+}
+
+func (t *v23Transport) Invite(addr string, direction spec.Direction, geometry spec.Geometry, row string, cancel <-chan struct{}) (Peer, spec.Geometry, error) {
+	ctx, stop := t.withCancel(cancel)
+	defer stop()
+	// Unlike spec.ScreenClient, the call reveals the blessings of the
+	// screen that accepted the invitation, which identify it.
+	call, err := v23.GetClient(ctx).StartCall(ctx, addr, "Invite", []interface{}{direction, geometry, row}, options.ServerAuthorizer{security.AllowEveryone()})
+	if err != nil {
+		return Peer{}, spec.Geometry{}, err
+	}
+	var g spec.Geometry
+	if err := call.Finish(&g); err != nil {
+		return Peer{}, spec.Geometry{}, err
+	}
+	_, blessings := call.RemoteBlessings()
+	key := blessings.PublicKey()
+	return Peer{Name: addr, Color: publicKeyColor(key), Id: key.String()}, g, nil
+}
+
+func (t *v23Transport) GiveAll(addr string, cancel <-chan struct{}) (GiveStream, error) {
+	ctx, stop := t.withCancel(cancel)
+	call, err := spec.ScreenClient(addr).GiveAll(ctx, options.ServerAuthorizer{security.AllowEveryone()})
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return v23GiveStream{call}, nil
+}
+
+func (t *v23Transport) Give(addr string, tri spec.Triangle, cancel <-chan struct{}) error {
+	ctx, stop := t.withCancel(cancel)
+	defer stop()
+	return spec.ScreenClient(addr).Give(ctx, tri, options.ServerAuthorizer{security.AllowEveryone()})
+}
+
+func (t *v23Transport) Align(addr string, side spec.Direction, marker float32, geometry spec.Geometry, cancel <-chan struct{}) error {
+	ctx, stop := t.withCancel(cancel)
+	defer stop()
+	return spec.ScreenClient(addr).Align(ctx, side, marker, geometry, options.ServerAuthorizer{security.AllowEveryone()})
+}
+
+func (t *v23Transport) JoinRow(addr string, head string, cancel <-chan struct{}) error {
+	ctx, stop := t.withCancel(cancel)
+	defer stop()
+	return spec.ScreenClient(addr).JoinRow(ctx, head, options.ServerAuthorizer{security.AllowEveryone()})
+}
+
+// withCancel returns a context that is canceled when cancel is closed or
+// stop is called.
+func (t *v23Transport) withCancel(cancel <-chan struct{}) (ctx *context.T, stop func()) {
+	ctx, stop = context.WithCancel(t.ctx)
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, stop
+}
+
+// scanQuery returns the discovery query that matches advertisements of the
+// Screen interface with all the provided attributes.
+func scanQuery(attributes map[string]string) string {
+	var names []string
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	clauses := []string{fmt.Sprintf("v.InterfaceName=%q", interfaceName)}
+	for _, name := range names {
+		clauses = append(clauses, fmt.Sprintf("v.Attributes[%q]=%q", name, attributes[name]))
+	}
+	return strings.Join(clauses, " AND ")
+}
+
+type v23GiveStream struct {
+	call spec.ScreenGiveAllClientCall
+}
+
+func (s v23GiveStream) Send(triangles []spec.Triangle) error {
+	return s.call.SendStream().Send(triangles)
+}
+
+func (s v23GiveStream) Recv() (int32, error) {
+	rs := s.call.RecvStream()
+	if rs.Advance() {
+		return rs.Value(), nil
+	}
+	if err := rs.Err(); err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+func (s v23GiveStream) Finish() error { return s.call.Finish() }
+
+// v23Screen implements the Screen RPC interface by delivering requests to a
+// ScreenHandler.
+type v23Screen struct {
+	h    ScreenHandler
+	give access.AccessList // Screens trusted to give triangles, see Peer.Trusted
+}
+
+func (s v23Screen) Invite(ctx *context.T, call rpc.ServerCall, direction spec.Direction, geometry spec.Geometry, row string) (spec.Geometry, error) {
+	inviter := caller(call)
+	g, err := s.h.Invite(inviter, direction, geometry, row, ctx.Done())
+	if err != nil {
+		return g, err
+	}
+	blessings, rejected := security.RemoteBlessingNames(ctx, call.Security())
+	ctx.Infof("Accepted invitation from %v@%v to stand on its %v (rejected blessings: %v)", blessings, inviter.Name, direction, rejected)
+	return g, nil
+}
+
+func (s v23Screen) Give(ctx *context.T, call rpc.ServerCall, t spec.Triangle) error {
+	peer, blessings, rejected := s.giver(ctx, call)
+	if err := s.h.Give(peer, []spec.Triangle{t}); err != nil {
+		ctx.Infof("Rejected a triangle from %v@%v: %v (rejected blessings: %v)", blessings, peer.Name, err, rejected)
+		return err
+	}
+	if ctx.V(3) {
+		ctx.Infof("Took a triangle from %v@%v (rejected blessings: %v)", blessings, peer.Name, rejected)
+	}
+	return nil
+}
+
+func (s v23Screen) GiveAll(ctx *context.T, call spec.ScreenGiveAllServerCall) error {
+	var (
+		rs                        = call.RecvStream()
+		ss                        = call.SendStream()
+		peer, blessings, rejected = s.giver(ctx, call)
+	)
+	for rs.Advance() {
+		batch := rs.Value()
+		if err := s.h.Give(peer, batch); err != nil {
+			ctx.Infof("Rejected %d triangles from %v@%v: %v (rejected blessings: %v)", len(batch), blessings, peer.Name, err, rejected)
+			return err
+		}
+		if ctx.V(3) {
+			ctx.Infof("Took %d triangles from %v@%v (rejected blessings: %v)", len(batch), blessings, peer.Name, rejected)
+		}
+		if err := ss.Send(int32(len(batch))); err != nil {
+			return err
+		}
+	}
+	return rs.Err()
+}
+
+func (s v23Screen) Align(ctx *context.T, call rpc.ServerCall, side spec.Direction, marker float32, geometry spec.Geometry) error {
+	return s.h.Align(caller(call), side, marker, geometry)
+}
+
+func (s v23Screen) JoinRow(ctx *context.T, call rpc.ServerCall, head string) error {
+	return s.h.JoinRow(caller(call), head)
+}
+
+// giver returns the Peer that made call to give triangles, along with its
+// blessings.
+func (s v23Screen) giver(ctx *context.T, call rpc.ServerCall) (Peer, []string, []security.RejectedBlessing) {
+	peer := caller(call)
+	blessings, rejected := security.RemoteBlessingNames(ctx, call.Security())
+	peer.Trusted = len(s.give.In) > 0 && s.give.Includes(blessings...)
+	return peer, blessings, rejected
+}
+
+// caller returns the Peer that made call.
+func caller(call rpc.ServerCall) Peer {
+	key := call.Security().RemoteBlessings().PublicKey()
+	return Peer{
+		Name:  call.RemoteEndpoint().Name(),
+		Color: publicKeyColor(key),
+		Id:    key.String(),
+	}
+}
+
+// v23Authorizer authorizes the requests made of a v23Transport. Any screen
+// may make them, except for Invite which only the screens in invite may
+// (unless it is empty).
+type v23Authorizer struct {
+	invite access.AccessList
+}
+
+func (a v23Authorizer) Authorize(ctx *context.T, call security.Call) error {
+	if call.Method() != "Invite" || len(a.invite.In) == 0 {
+		return nil
+	}
+	blessings, rejected := security.RemoteBlessingNames(ctx, call)
+	if a.invite.Includes(blessings...) {
+		return nil
+	}
+	ctx.Infof("Rejected invitation from %v (rejected blessings: %v)", blessings, rejected)
+	return fmt.Errorf("%v may not invite this screen", blessings)
+}
+
+// parseAccessList returns the access list of the comma-separated blessing
+// patterns in s.
+func parseAccessList(s string) (access.AccessList, error) {
+	var acl access.AccessList
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); len(p) == 0 {
+			continue
+		}
+		pattern := security.BlessingPattern(p)
+		if !pattern.IsValid() {
+			return acl, fmt.Errorf("invalid blessing pattern %q", p)
+		}
+		acl.In = append(acl.In, pattern)
+	}
+	return acl, nil
+}
+
+func publicKeyColor(key security.PublicKey) Color {
+	bytes, _ := key.MarshalBinary()
+	return selectColor(bytes)
+}
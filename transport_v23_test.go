@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"v.io/v23/security"
+)
+
+func TestParseAccessList(t *testing.T) {
+	tests := []struct {
+		s        string
+		patterns []security.BlessingPattern // nil if the list is empty
+		valid    bool
+	}{
+		{"dev:alice", []security.BlessingPattern{"dev:alice"}, true},
+		{" dev:alice , dev:bob", []security.BlessingPattern{"dev:alice", "dev:bob"}, true},
+		{"dev:alice:$", []security.BlessingPattern{"dev:alice:$"}, true},
+		{"", nil, true},
+		{",,", nil, true},
+		{"dev::alice", nil, false},
+		{"dev:alice,dev:", nil, false},
+		{"dev:$:alice", nil, false},
+	}
+	for _, test := range tests {
+		acl, err := parseAccessList(test.s)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%q: got error %v, want valid=%v", test.s, err, test.valid)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(acl.In, test.patterns) {
+			t.Errorf("%q: got %v, want %v", test.s, acl.In, test.patterns)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/asimshankar/triangles/spec"
+	"github.com/gorilla/websocket"
+	"golang.org/x/mobile/event/size"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var flagWeb = flag.String("web", "", "If set, the address on which to serve a web client that lets browsers join other screens, instead of running a screen")
+
+// serveWeb serves the web client at addr and links every browser that
+// connects to it with other screens, on its behalf.
+func serveWeb(addr string) error {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, webClient)
+	})
+	http.HandleFunc("/screen", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := webUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("Failed to accept a WebSocket from %v: %v", r.RemoteAddr, err)
+			return
+		}
+		defer conn.Close()
+		transport, err := newBridgeTransport(nextBridge())
+		if err != nil {
+			conn.WriteJSON(webMessage{Type: "error", Error: err.Error()})
+			return
+		}
+		room := r.FormValue("room")
+		if len(room) == 0 {
+			room = *flagRoom
+		}
+		log.Printf("Browser at %v joined room %q", r.RemoteAddr, room)
+		bridgeWebScreen(conn, transport, *flagInvite, room)
+		log.Printf("Browser at %v left", r.RemoteAddr)
+	})
+	log.Printf("Serving the web client on %v", addr)
+	return http.ListenAndServe(addr, nil)
+}
+
+var webUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+var (
+	bridgesMu sync.Mutex
+	bridges   int // Number of browsers that connected to serveWeb
+)
+
+// nextBridge returns the number of the next browser to connect to serveWeb,
+// from 1.
+func nextBridge() int {
+	bridgesMu.Lock()
+	defer bridgesMu.Unlock()
+	bridges++
+	return bridges
+}
+
+// webConn is the WebSocket of a web client, on which webMessages are
+// exchanged.
+type webConn interface {
+	ReadJSON(v interface{}) error
+	WriteJSON(v interface{}) error
+}
+
+// webMessage is exchanged with the web client over its WebSocket, encoded as
+// JSON. Only the fields relevant to its Type are set.
+//
+// The server sends:
+//   - "ready": Color identifies the screen
+//   - "error": Error made it impossible to link the screen with others
+//   - "invitation": from the screen Name, of Color, on the Direction edge,
+//     to be accepted once the user confirms that it displays Code too
+//   - "pairing": Code is to be displayed while the screen on the Direction
+//     edge is invited, or no longer if empty
+//   - "withdrawn": the last invitation was withdrawn
+//   - "candidate": the screen Id, of Color and running OS, can be invited to
+//     stand on the Direction edge (Active), or no longer can (see --pick)
+//   - "neighbour": whether there is a screen on the Direction edge (Active)
+//   - "triangle": Triangle was given to the screen
+//
+// The web client sends:
+//   - "size": the Geometry of the screen, whenever it changes
+//   - "accept": the last invitation was accepted by the user
+//   - "reject": the last invitation was rejected by the user
+//   - "pick": the user picked the candidate Id to stand on the Direction edge
+//   - "depart": Triangle went off the Direction edge of the screen
+//   - "room": the user moved the screen to Room (see --room)
+//
+// The web client may also pick the room it starts in with the "room" query
+// parameter of the WebSocket URL, it otherwise starts in --room.
+type webMessage struct {
+	Type      string
+	Color     *Color         `json:",omitempty"`
+	Name      string         `json:",omitempty"`
+	Id        string         `json:",omitempty"`
+	OS        string         `json:",omitempty"`
+	Direction string         `json:",omitempty"`
+	Active    bool           `json:",omitempty"`
+	Triangle  *spec.Triangle `json:",omitempty"`
+	Geometry  *spec.Geometry `json:",omitempty"`
+	Room      string         `json:",omitempty"`
+	Code      string         `json:",omitempty"`
+	Error     string         `json:",omitempty"`
+}
+
+// bridgeWebScreen links the screen of the web client on conn with other
+// screens in room over transport, inviting them to stand in the invite
+// directions (see --invite), until the web client goes away.
+//
+// The web client owns its triangles and simulates them, the bridge plays the
+// part of main for it: triangles given by other screens are forwarded to it
+// and those that go off its edges are handed off to the screen there.
+func bridgeWebScreen(conn webConn, transport Transport, invite, room string) {
+	var (
+		chMyScreen      = make(chan *spec.Triangle) // Triangles to forward to the web client
+		otherScreens    = make(map[spec.Direction]*otherScreen)
+		networkChannels = setupNetwork(transport, invite, room, chMyScreen)
+		invitation      Invitation // The last invitation forwarded to the web client, if not yet responded to
+
+		fromClient = make(chan webMessage)
+		done       = make(chan struct{}) // Closed when the web client goes away
+	)
+	go func() {
+		defer close(fromClient)
+		for {
+			var m webMessage
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+			select {
+			case fromClient <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for _, dir := range spec.DirectionAll {
+		otherScreens[dir] = newOtherScreen(dir, nil, chMyScreen)
+	}
+	defer func() {
+		close(done)
+		for _, s := range otherScreens {
+			s.close()
+		}
+		closeNetwork(networkChannels, chMyScreen)
+	}()
+	send := func(m webMessage) bool {
+		if err := conn.WriteJSON(m); err != nil {
+			log.Printf("Failed to write to the web client: %v", err)
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case ready := <-networkChannels.Ready:
+			switch v := ready.(type) {
+			case error:
+				send(webMessage{Type: "error", Error: v.Error()})
+				return
+			case Color:
+				if !send(webMessage{Type: "ready", Color: &v}) {
+					return
+				}
+			}
+			networkChannels.Ready = nil
+		case inv := <-networkChannels.Invitations:
+			invitation = inv
+			if !send(webMessage{Type: "invitation", Name: inv.Name, Color: &inv.Color, Direction: inv.Direction.String(), Code: inv.Code}) {
+				return
+			}
+		case p := <-networkChannels.Pairings:
+			if !send(webMessage{Type: "pairing", Direction: p.Direction.String(), Code: p.Code}) {
+				return
+			}
+		case <-invitation.Withdrawn:
+			log.Printf("Invitation from %v withdrawn", invitation.Name)
+			invitation = Invitation{}
+			if !send(webMessage{Type: "withdrawn"}) {
+				return
+			}
+		case c := <-networkChannels.Candidates:
+			if !send(webMessage{Type: "candidate", Id: c.Id, Color: &c.Color, OS: c.OS, Direction: c.Direction.String(), Active: !c.Lost}) {
+				return
+			}
+		case n := <-networkChannels.Neighbours:
+			otherScreens[n.Direction].close()
+			otherScreens[n.Direction] = newOtherScreen(n.Direction, n.Triangles, chMyScreen)
+			if !send(webMessage{Type: "neighbour", Direction: n.Direction.String(), Active: n.Triangles != nil}) {
+				return
+			}
+		case t := <-chMyScreen:
+			if !send(webMessage{Type: "triangle", Triangle: t}) {
+				return
+			}
+		case m, ok := <-fromClient:
+			if !ok {
+				return
+			}
+			switch m.Type {
+			case "size":
+				if g := m.Geometry; g != nil {
+					networkChannels.Resize(size.Event{WidthPx: int(g.WidthPx), HeightPx: int(g.HeightPx), PixelsPerPt: g.PixelsPerInch / 72})
+				}
+			case "accept", "reject":
+				if invitation.Response == nil {
+					break
+				}
+				var err error
+				if m.Type == "reject" {
+					err = fmt.Errorf("user rejected")
+				}
+				log.Printf("Web client responded to the invitation from %q: %v", invitation.Name, m.Type)
+				respond(invitation, err)
+				invitation = Invitation{}
+			case "pick":
+				dir, err := spec.DirectionFromString(m.Direction)
+				if err != nil {
+					log.Printf("Ignoring invalid pick from the web client: %+v", m)
+					break
+				}
+				log.Printf("Web client picked %q to invite to its %v", m.Id, dir)
+				networkChannels.Pick(dir, m.Id)
+			case "depart":
+				dir, err := spec.DirectionFromString(m.Direction)
+				if err != nil || m.Triangle == nil {
+					log.Printf("Ignoring invalid departure from the web client: %+v", m)
+					break
+				}
+				trace(m.Triangle, "went off the %v edge of the web client", dir)
+				go otherScreens[dir].send([]*spec.Triangle{m.Triangle})
+			case "room":
+				log.Printf("Web client moved to room %q", m.Room)
+				networkChannels.SetRoom(m.Room)
+			}
+		}
+	}
+}
+
+// respond sends the response to inv asynchronously, as the networkManager
+// may be busy notifying the screen of something else.
+func respond(inv Invitation, err error) {
+	go func() { inv.Response <- err }()
+}
+
+// webClient is the page served by serveWeb, which draws the triangles on the
+// screen with a canvas and moves them as sim.World does (but without
+// collisions between them).
+const webClient = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1, user-scalable=no">
+<title>triangles</title>
+<style>
+html, body { margin: 0; height: 100%; overflow: hidden; background: black; }
+canvas { display: block; touch-action: none; }
+#room { position: fixed; left: 1em; bottom: 1em; width: 8em; opacity: 0.5; }
+</style>
+</head>
+<body>
+<canvas id="screen"></canvas>
+<input id="room" placeholder="Room" autocomplete="off">
+<script>
+"use strict";
+// Constants of sim and gl.go.
+var defaultSize = 0.4, gravity = 0.36, timestep = 1 / 120, maxElapsed = 0.25, bannerWidth = 0.1;
+
+// The room is kept in the fragment of the URL, so that it survives reloads.
+var room = document.getElementById("room");
+room.value = decodeURIComponent(location.hash.slice(1));
+
+var canvas = document.getElementById("screen"),
+    ctx = canvas.getContext("2d"),
+    socket = new WebSocket((location.protocol == "https:" ? "wss://" : "ws://") + location.host + "/screen" +
+                           (room.value ? "?room=" + encodeURIComponent(room.value) : "")),
+    screenID = randomID(),
+    triangles = [],
+    open = {},           // Edges with another screen on them
+    banner = null,       // Color of this screen, once ready
+    invitation = null,   // The pending invitation, if any
+    candidates = {},     // Screens that can be invited, by edge (see --pick)
+    codes = {},          // Pairing codes of the invitations sent, by edge
+    lastFrame = 0,
+    pending = 0;         // Time not yet simulated
+
+function randomID() {
+  var bytes = new Uint8Array(16), ret = "";
+  crypto.getRandomValues(bytes);
+  for (var i = 0; i < bytes.length; i++) ret += (bytes[i] < 16 ? "0" : "") + bytes[i].toString(16);
+  return ret;
+}
+
+function send(m) {
+  if (socket.readyState == WebSocket.OPEN) socket.send(JSON.stringify(m));
+}
+
+function resize() {
+  var ratio = window.devicePixelRatio || 1;
+  canvas.width = window.innerWidth * ratio;
+  canvas.height = window.innerHeight * ratio;
+  canvas.style.width = window.innerWidth + "px";
+  canvas.style.height = window.innerHeight + "px";
+  // CSS pixels are 1/96th of an inch.
+  send({Type: "size", Geometry: {WidthPx: canvas.width, HeightPx: canvas.height, PixelsPerInch: 96 * ratio}});
+}
+
+function spawn(x) {
+  triangles.push({X: x, Y: 1, Dx: 0, Dy: 0, R: banner.R, G: banner.G, B: banner.B,
+                  Angle: 0, Omega: 0, Size: defaultSize, Shape: 0,
+                  Id: randomID(), Origin: screenID, Hops: 0});
+}
+
+function size(t) { return t.Size > 0 ? t.Size : defaultSize; }
+
+function floorHeight(t) {
+  switch (t.Shape) {
+    case 1: return size(t) / 2;
+    case 2: return Math.sqrt(3) * size(t) / 4;
+  }
+  return size(t) / (2 * Math.sqrt(3));
+}
+
+function outline(t) {
+  var s = size(t), ret = [];
+  switch (t.Shape) {
+    case 1: return [[-s / 2, -s / 2], [s / 2, -s / 2], [s / 2, s / 2], [-s / 2, s / 2]];
+    case 2:
+      for (var i = 0; i < 6; i++) ret.push([Math.cos(i * Math.PI / 3) * s / 2, Math.sin(i * Math.PI / 3) * s / 2]);
+      return ret;
+  }
+  var h = Math.sqrt(3) * s / 2;
+  return [[-s / 2, -h / 2], [s / 2, -h / 2], [0, h / 2]];
+}
+
+// step moves all triangles by dt seconds and hands off the ones that went
+// off an edge, as sim.World.Step does.
+function step(dt) {
+  var mine = [];
+  triangles.forEach(function(t) {
+    t.Dy -= gravity * dt;
+    t.X += t.Dx * dt;
+    t.Y += t.Dy * dt;
+    t.Angle += t.Omega * dt;
+    if (!open.Below && t.Y <= -1) {
+      t.Dy = -t.Dy;
+      t.Y = -1;
+    } else if (!open.Above && t.Y >= 1 - floorHeight(t)) {
+      t.Dy = -t.Dy;
+      t.Y = 1 - floorHeight(t);
+    }
+    var dir = t.X < -1 ? "Left" : t.X > 1 ? "Right" : t.Y > 1 ? "Above" : t.Y < -1 ? "Below" : "";
+    if (dir) {
+      send({Type: "depart", Direction: dir, Triangle: t});
+    } else {
+      mine.push(t);
+    }
+  });
+  triangles = mine;
+}
+
+function rgb(c) {
+  return "rgb(" + [c.R, c.G, c.B].map(function(v) { return Math.round(v * 255); }).join(",") + ")";
+}
+
+// fillRect fills a rectangle given in screen coordinates.
+function fillRect(color, x0, y0, x1, y1) {
+  ctx.fillStyle = color;
+  ctx.fillRect(x0, -y1, x1 - x0, y1 - y0);
+}
+
+// edgeBanner returns the rectangle of the banner drawn on the edge dir, as
+// in gl.go.
+function edgeBanner(dir) {
+  switch (dir) {
+    case "Right": return [1 - bannerWidth, -1, 1, 1];
+    case "Above": return [-1, 1 - 2 * bannerWidth, 1, 1 - bannerWidth];
+    case "Below": return [-1, -1, 1, -1 + bannerWidth];
+  }
+  return [-1, -1, -1 + bannerWidth, 1];
+}
+
+// candidateSwatch returns the rectangle covered by the swatch of the i-th of
+// n candidates along the edge dir, as in gl.go.
+function candidateSwatch(dir, i, n) {
+  var b = edgeBanner(dir), gap = 0.01;
+  if (dir == "Above" || dir == "Below") {
+    var w = (b[2] - b[0]) / n;
+    return [b[0] + i * w + gap, b[1], b[0] + (i + 1) * w - gap, b[3]];
+  }
+  var h = (b[3] - b[1]) / n;
+  return [b[0], b[3] - (i + 1) * h + gap, b[2], b[3] - i * h - gap];
+}
+
+// codeAnchor returns where the pairing code of an invitation across the edge
+// dir is drawn, next to its banner as in gl.go, and how it is aligned there.
+function codeAnchor(dir) {
+  switch (dir) {
+    case "Right": return [1 - bannerWidth - 0.04, 0, "right"];
+    case "Above": return [0, 1 - 2 * bannerWidth - 0.12, "center"];
+    case "Below": return [0, -1 + bannerWidth + 0.12, "center"];
+  }
+  return [-1 + bannerWidth + 0.04, 0, "left"];
+}
+
+function inRect(r, x, y) { return x >= r[0] && x <= r[2] && y >= r[1] && y <= r[3]; }
+
+function paint() {
+  ctx.setTransform(1, 0, 0, 1, 0, 0);
+  ctx.fillStyle = "black";
+  ctx.fillRect(0, 0, canvas.width, canvas.height);
+  // Screen coordinates span [-1, 1], with Y pointing up.
+  ctx.setTransform(canvas.width / 2, 0, 0, canvas.height / 2, canvas.width / 2, canvas.height / 2);
+  triangles.forEach(function(t) {
+    var c = Math.cos(t.Angle), s = Math.sin(t.Angle);
+    ctx.beginPath();
+    outline(t).forEach(function(v) {
+      ctx.lineTo(t.X + v[0] * c - v[1] * s, -(t.Y + v[0] * s + v[1] * c));
+    });
+    ctx.fillStyle = rgb(t);
+    ctx.fill();
+  });
+  if (banner) fillRect(rgb(banner), -1, 1 - bannerWidth, 1, 1);
+  var labels = [];
+  Object.keys(candidates).forEach(function(dir) {
+    candidates[dir].forEach(function(c, i, list) {
+      var r = candidateSwatch(dir, i, list.length);
+      fillRect.apply(null, [rgb(c.Color)].concat(r));
+      labels.push([c.OS, (r[0] + r[2]) / 2, (r[1] + r[3]) / 2]);
+    });
+  });
+  // Label the swatches with the OS of the candidates, in pixels so that the
+  // text is not stretched.
+  ctx.setTransform(1, 0, 0, 1, 0, 0);
+  ctx.fillStyle = "black";
+  ctx.font = Math.round(12 * (window.devicePixelRatio || 1)) + "px sans-serif";
+  ctx.textAlign = "center";
+  ctx.textBaseline = "middle";
+  labels.forEach(function(l) {
+    ctx.fillText(l[0], (l[1] + 1) * canvas.width / 2, (1 - l[2]) * canvas.height / 2);
+  });
+  var shown = {};
+  for (var dir in codes) shown[dir] = codes[dir];
+  if (invitation && invitation.Code) shown[invitation.Direction] = invitation.Code;
+  ctx.fillStyle = "white";
+  ctx.font = "bold " + Math.round(32 * (window.devicePixelRatio || 1)) + "px monospace";
+  Object.keys(shown).forEach(function(dir) {
+    var a = codeAnchor(dir);
+    ctx.textAlign = a[2];
+    ctx.fillText(shown[dir], (a[0] + 1) * canvas.width / 2, (1 - a[1]) * canvas.height / 2);
+  });
+  ctx.setTransform(canvas.width / 2, 0, 0, canvas.height / 2, canvas.width / 2, canvas.height / 2);
+  if (invitation && Math.floor(Date.now() / 1000) % 2 == 0) {
+    fillRect.apply(null, [rgb(invitation.Color)].concat(edgeBanner(invitation.Direction)));
+  }
+}
+
+function frame(now) {
+  if (lastFrame) {
+    pending += Math.min((now - lastFrame) / 1000, maxElapsed);
+    for (; pending >= timestep; pending -= timestep) step(timestep);
+  }
+  lastFrame = now;
+  paint();
+  requestAnimationFrame(frame);
+}
+
+// Touching the top banner spawns a triangle. Tapping the banner of an
+// invitation accepts it, once the user found its code on the inviter too,
+// swiping it rejects it.
+var touchStart = null;
+canvas.addEventListener("pointerdown", function(e) { touchStart = e; });
+canvas.addEventListener("pointerup", function(e) {
+  if (!touchStart) return;
+  var x = 2 * touchStart.clientX / window.innerWidth - 1,
+      y = 1 - 2 * touchStart.clientY / window.innerHeight,
+      dx = e.clientX - touchStart.clientX,
+      dy = e.clientY - touchStart.clientY;
+  touchStart = null;
+  if (invitation) {
+    var b = edgeBanner(invitation.Direction);
+    if (x >= b[0] && x <= b[2] && y >= b[1] && y <= b[3]) {
+      var swipe = window.innerWidth / 2;
+      send({Type: dx * dx + dy * dy > swipe * swipe ? "reject" : "accept"});
+      invitation = null;
+      return;
+    }
+  }
+  for (var dir in candidates) {
+    var list = candidates[dir];
+    for (var i = 0; i < list.length; i++) {
+      if (inRect(candidateSwatch(dir, i, list.length), x, y)) {
+        send({Type: "pick", Direction: dir, Id: list[i].Id});
+        return;
+      }
+    }
+  }
+  if (banner && y >= 1 - 2 * bannerWidth) spawn(x);
+});
+
+room.addEventListener("change", function() {
+  location.hash = encodeURIComponent(room.value);
+  send({Type: "room", Room: room.value});
+});
+
+socket.onopen = resize;
+socket.onmessage = function(e) {
+  var m = JSON.parse(e.data);
+  switch (m.Type) {
+    case "ready":
+      banner = m.Color;
+      spawn(0);
+      break;
+    case "error":
+      alert(m.Error);
+      break;
+    case "invitation":
+      invitation = m;
+      break;
+    case "withdrawn":
+      invitation = null;
+      break;
+    case "pairing":
+      if (m.Code) codes[m.Direction] = m.Code;
+      else delete codes[m.Direction];
+      break;
+    case "candidate":
+      var list = (candidates[m.Direction] || []).filter(function(c) { return c.Id != m.Id; });
+      if (m.Active) list.push(m);
+      candidates[m.Direction] = list;
+      break;
+    case "neighbour":
+      open[m.Direction] = !!m.Active;
+      break;
+    case "triangle":
+      triangles.push(m.Triangle);
+      break;
+  }
+};
+socket.onclose = function() { banner = null; };
+window.addEventListener("resize", resize);
+resize();
+requestAnimationFrame(frame);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/asimshankar/triangles/sim"
+	"github.com/asimshankar/triangles/spec"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeWebConn plays the part of the WebSocket of a web client.
+type fakeWebConn struct {
+	fromClient chan webMessage // Closed when the web client goes away
+	toClient   chan webMessage
+}
+
+func newFakeWebConn() *fakeWebConn {
+	return &fakeWebConn{
+		fromClient: make(chan webMessage, 10),
+		toClient:   make(chan webMessage, 100),
+	}
+}
+
+func (c *fakeWebConn) ReadJSON(v interface{}) error {
+	m, ok := <-c.fromClient
+	if !ok {
+		return io.EOF
+	}
+	*v.(*webMessage) = m
+	return nil
+}
+
+func (c *fakeWebConn) WriteJSON(v interface{}) error {
+	c.toClient <- v.(webMessage)
+	return nil
+}
+
+// expect returns the next message of type typ sent to the web client,
+// skipping the others.
+func (c *fakeWebConn) expect(t *testing.T, typ string) webMessage {
+	timeout := time.After(maxSimulatedLinkTime)
+	for {
+		select {
+		case m := <-c.toClient:
+			if m.Type == "error" {
+				t.Fatalf("Waiting for %q: got error %v", typ, m.Error)
+			}
+			if m.Type == typ {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("No %q message after %v", typ, maxSimulatedLinkTime)
+		}
+	}
+}
+
+func TestWebBridges(t *testing.T) {
+	var (
+		network     = newMemNetwork()
+		left, right = newFakeWebConn(), newFakeWebConn()
+		done        = make(chan struct{}, 2)
+		bridge      = func(conn *fakeWebConn, invite string) {
+			bridgeWebScreen(conn, network.NewTransport(), invite, "")
+			done <- struct{}{}
+		}
+		geometry = &spec.Geometry{WidthPx: 800, HeightPx: 600, PixelsPerInch: 72}
+	)
+	left.fromClient <- webMessage{Type: "size", Geometry: geometry}
+	right.fromClient <- webMessage{Type: "size", Geometry: geometry}
+	go bridge(left, "right")
+	go bridge(right, "")
+	defer func() {
+		close(left.fromClient)
+		close(right.fromClient)
+		<-done
+		<-done
+	}()
+
+	leftColor := left.expect(t, "ready").Color
+	if rightColor := right.expect(t, "ready").Color; *leftColor == *rightColor {
+		t.Errorf("Both bridged screens have color %v", *leftColor)
+	}
+	var (
+		inv     = right.expect(t, "invitation")
+		pairing = left.expect(t, "pairing")
+	)
+	if *inv.Color != *leftColor || inv.Direction != "Left" {
+		t.Errorf("Got an invitation from the %v screen of color %v, want the Left one of color %v", inv.Direction, *inv.Color, *leftColor)
+	}
+	if len(inv.Code) == 0 || inv.Code != pairing.Code {
+		t.Errorf("The invited screen displays code %q, the inviter %q", inv.Code, pairing.Code)
+	}
+	right.fromClient <- webMessage{Type: "accept"}
+	if n := left.expect(t, "neighbour"); n.Direction != "Right" || !n.Active {
+		t.Errorf("Inviter got neighbour %+v, want an active one on the Right", n)
+	}
+	if n := right.expect(t, "neighbour"); n.Direction != "Left" || !n.Active {
+		t.Errorf("Invited screen got neighbour %+v, want an active one on the Left", n)
+	}
+
+	tri := &spec.Triangle{Id: "departed", X: 1, Y: 0.5, Dx: 0.1, Size: sim.DefaultSize}
+	left.fromClient <- webMessage{Type: "depart", Direction: "Right", Triangle: tri}
+	if got := right.expect(t, "triangle").Triangle; got.Id != tri.Id {
+		t.Errorf("Got triangle %q, want %q", got.Id, tri.Id)
+	}
+}